@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jacobbrewer1/uhttp"
+	"github.com/jacobbrewer1/web"
+	"github.com/jacobbrewer1/web/k8s"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+const (
+	// apiReadHeaderTimeout is the maximum duration allowed to read the headers of an API request.
+	apiReadHeaderTimeout = 10 * time.Second
+
+	// peerRequestTimeout is the maximum duration allowed for a request to another replica.
+	peerRequestTimeout = 10 * time.Second
+
+	// headerForwardedBy marks a request that has been forwarded by another replica so that it is
+	// never forwarded twice, even if the replicas briefly disagree on ownership.
+	headerForwardedBy = "X-Secret-Sync-Forwarded-By"
+
+	// queryParamScope restricts the secrets listing to the replica that receives the request.
+	queryParamScope = "scope"
+	scopeLocal      = "local"
+
+	// queryParamCluster selects the cluster of the secret to sync, the local cluster by default.
+	queryParamCluster = "cluster"
+
+	// queryParamVersion is the vault version to pin a secret to.
+	queryParamVersion = "version"
+
+	// bearerPrefix is the scheme of the Authorization header of API requests.
+	bearerPrefix = "Bearer "
+)
+
+// knownAPIKeys are the keys of the api configuration.
+var knownAPIKeys = sets.New(
+	"token_file",
+)
+
+var (
+	ErrSecretNotConfigured = errors.New("secret is not configured")
+	ErrOwnerUnknown        = errors.New("owning replica is unknown")
+	ErrInvalidVersion      = errors.New("version must be a positive integer")
+	ErrUnauthorized        = errors.New("missing or invalid bearer token")
+	ErrEmptyAPIToken       = errors.New("api token file is empty")
+)
+
+// secretList is the response body of the secrets listing.
+type secretList struct {
+	Secrets []secretStatus `json:"secrets"`
+}
+
+// peerClient is the HTTP client used to query other replicas.
+var peerClient = &http.Client{
+	Timeout: peerRequestTimeout,
+}
+
+// serveAPI runs the operational HTTP API until the application shuts down. The API is served by the
+// existing web server on the metrics port, alongside the metrics. It is only served when a bearer
+// token is configured, as it can change managed secrets.
+func (a *App) serveAPI(
+	l *slog.Logger,
+) web.AsyncTaskFunc {
+	return func(ctx context.Context) {
+		if err := a.base.StartServer("metrics", &http.Server{
+			Addr:              fmt.Sprintf(":%d", web.MetricsPort),
+			Handler:           a.apiRouter(l, a.base.Viper().GetString("api.token_file")),
+			ReadHeaderTimeout: apiReadHeaderTimeout,
+		}); err != nil {
+			l.Error("Error starting metrics server", slog.String(loggingKeyError, err.Error()))
+			return
+		}
+
+		<-ctx.Done()
+	}
+}
+
+// apiRouter routes the metrics and, if a token file is given, the operational API.
+func (a *App) apiRouter(l *slog.Logger, tokenFile string) *mux.Router {
+	r := mux.NewRouter()
+	r.Handle("/metrics", promhttp.Handler()).Methods(http.MethodGet)
+
+	if tokenFile == "" {
+		l.Warn("No api.token_file configured, the operational API is disabled")
+		return r
+	}
+
+	api := r.PathPrefix("/v1").Subrouter()
+	api.Use(bearerAuth(l, tokenFile))
+	api.HandleFunc("/secrets", a.listSecretsHandler(l)).Methods(http.MethodGet)
+	api.HandleFunc("/secrets/{namespace}/{name}/sync", a.syncSecretHandler(l)).Methods(http.MethodPost)
+	api.HandleFunc("/secrets/{namespace}/{name}/pin", a.pinSecretHandler(l)).Methods(http.MethodPost, http.MethodDelete)
+	return r
+}
+
+// bearerAuth rejects requests that do not carry the token in the file as a bearer token. The file is
+// read on every request so that the token can be rotated without a restart.
+func bearerAuth(l *slog.Logger, tokenFile string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			want, err := readCredential(tokenFile)
+			if err != nil || want == "" {
+				if err == nil {
+					err = ErrEmptyAPIToken
+				}
+				l.Error("Error reading api token", slog.String(loggingKeyError, err.Error()))
+				uhttp.MustEncode(w, http.StatusServiceUnavailable, uhttp.NewHTTPError(http.StatusServiceUnavailable, err))
+				return
+			}
+
+			got, ok := strings.CutPrefix(r.Header.Get("Authorization"), bearerPrefix)
+			if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				uhttp.MustEncode(w, http.StatusUnauthorized, uhttp.NewHTTPError(http.StatusUnauthorized, ErrUnauthorized))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// listSecretsHandler lists every configured secret along with its owning replica and last known
+// sync state. The state of secrets owned by other replicas is fetched from those replicas.
+func (a *App) listSecretsHandler(
+	l *slog.Logger,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		localOnly := r.URL.Query().Get(queryParamScope) == scopeLocal
+
+		type peerStatuses struct {
+			statuses map[string]secretStatus
+			err      error
+		}
+		peers := make(map[string]*peerStatuses)
+
+		secrets := a.currentConfig().Secrets
+		list := &secretList{
+			Secrets: make([]secretStatus, 0, len(secrets)),
+		}
+		for _, secret := range secrets {
+			owner, addr := a.secretOwner(secret)
+			st, _ := a.status.get(secret)
+			st.Owner = owner
+
+			if a.owners.IsLocal(owner) {
+				list.Secrets = append(list.Secrets, st)
+				continue
+			} else if localOnly {
+				continue
+			}
+
+			peer, ok := peers[owner]
+			if !ok {
+				peer = new(peerStatuses)
+				peer.statuses, peer.err = fetchPeerStatuses(r.Context(), addr, r.Header.Get("Authorization"))
+				if peer.err != nil {
+					l.Warn("Error fetching statuses from replica",
+						slog.String(loggingKeyOwner, owner),
+						slog.String(loggingKeyError, peer.err.Error()),
+					)
+				}
+				peers[owner] = peer
+			}
+
+			if peer.err != nil {
+				st.LastError = peer.err.Error()
+			} else if remote, ok := peer.statuses[st.key()]; ok {
+				st = remote
+				st.Owner = owner
+			}
+			list.Secrets = append(list.Secrets, st)
+		}
+
+		uhttp.MustEncode(w, http.StatusOK, list)
+	}
+}
+
+// syncSecretHandler forces an immediate reconcile of a single secret. Requests for secrets owned by
+// another replica are forwarded to that replica.
+func (a *App) syncSecretHandler(
+	l *slog.Logger,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		secret := a.findSecret(r.URL.Query().Get(queryParamCluster), vars["namespace"], vars["name"])
+		if secret == nil {
+			uhttp.MustEncode(w, http.StatusNotFound, uhttp.NewHTTPError(http.StatusNotFound, ErrSecretNotConfigured))
+			return
+		}
+
+		l := l.With(
+			slog.String(loggingKeyCluster, clusterDisplayName(secret.cluster)),
+			slog.String(loggingKeyNamespace, secret.DestinationNamespace),
+			slog.String(loggingKeyDestination, secret.DestinationName),
+		)
+
+		owner, addr := a.owners.Owner(secret.shardKey())
+		if !a.owners.IsLocal(owner) && r.Header.Get(headerForwardedBy) == "" {
+			l.Debug("Forwarding sync request to owning replica", slog.String(loggingKeyOwner, owner))
+			forwardToPeer(l, w, r, addr)
+			return
+		}
+
+		l.Info("Forced sync requested")
+		err := a.reconcileNow(r.Context(), l, secret)
+		st, _ := a.status.get(secret)
+		st.Owner = k8s.PodName()
+		if err != nil {
+			uhttp.MustEncode(w, http.StatusInternalServerError, uhttp.NewHTTPError(http.StatusInternalServerError, err, st))
+			return
+		}
+
+		uhttp.MustEncode(w, http.StatusOK, st)
+	}
+}
+
+// pinSecretHandler pins a secret to the vault version in the version query parameter, or removes
+// the pin on DELETE, by annotating its destination. Requests for secrets owned by another replica are
+// forwarded to that replica.
+func (a *App) pinSecretHandler(
+	l *slog.Logger,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		secret := a.findSecret(r.URL.Query().Get(queryParamCluster), vars["namespace"], vars["name"])
+		if secret == nil {
+			uhttp.MustEncode(w, http.StatusNotFound, uhttp.NewHTTPError(http.StatusNotFound, ErrSecretNotConfigured))
+			return
+		} else if secret.reverse() || secret.File != nil {
+			uhttp.MustEncode(w, http.StatusBadRequest, uhttp.NewHTTPError(http.StatusBadRequest, ErrPinNotSupported))
+			return
+		}
+
+		version := 0
+		if r.Method == http.MethodPost {
+			var err error
+			version, err = strconv.Atoi(r.URL.Query().Get(queryParamVersion))
+			if err != nil || version <= 0 {
+				uhttp.MustEncode(w, http.StatusBadRequest, uhttp.NewHTTPError(http.StatusBadRequest, ErrInvalidVersion))
+				return
+			}
+		}
+
+		l := l.With(
+			slog.String(loggingKeyCluster, clusterDisplayName(secret.cluster)),
+			slog.String(loggingKeyNamespace, secret.DestinationNamespace),
+			slog.String(loggingKeyDestination, secret.DestinationName),
+		)
+
+		owner, addr := a.owners.Owner(secret.shardKey())
+		if !a.owners.IsLocal(owner) && r.Header.Get(headerForwardedBy) == "" {
+			l.Debug("Forwarding pin request to owning replica", slog.String(loggingKeyOwner, owner))
+			forwardToPeer(l, w, r, addr)
+			return
+		}
+
+		s, err := a.newSyncer().forCluster(secret.cluster)
+		if err == nil {
+			err = s.setPin(r.Context(), secret, version)
+		}
+		if err != nil {
+			l.Error("Error setting pin", slog.String(loggingKeyError, err.Error()))
+			uhttp.MustEncode(w, http.StatusInternalServerError, uhttp.NewHTTPError(http.StatusInternalServerError, err))
+			return
+		}
+
+		// The secret is synced once the annotation reaches the informer cache, see
+		// controlChangedHandler.
+		l.Info("Pin requested", slog.Int(loggingKeyVersion, version))
+		st, _ := a.status.get(secret)
+		st.Owner = k8s.PodName()
+		uhttp.MustEncode(w, http.StatusAccepted, st)
+	}
+}
+
+// findSecret returns the configured secret with the given destination, or nil if there is none. The
+// empty cluster and the local cluster's name both select the local cluster.
+func (a *App) findSecret(cluster, namespace, name string) *Secret {
+	if cluster == localClusterName {
+		cluster = ""
+	}
+
+	for _, s := range a.currentConfig().Secrets {
+		if s.cluster == cluster && s.DestinationNamespace == namespace && s.DestinationName == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// peerURL returns the API URL of the replica at the given address.
+func peerURL(addr string) *url.URL {
+	return &url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(addr, strconv.Itoa(web.MetricsPort)),
+	}
+}
+
+// forwardToPeer proxies the request to the replica at the given address.
+func forwardToPeer(l *slog.Logger, w http.ResponseWriter, r *http.Request, addr string) {
+	if addr == "" {
+		uhttp.MustEncode(w, http.StatusServiceUnavailable, uhttp.NewHTTPError(http.StatusServiceUnavailable, ErrOwnerUnknown))
+		return
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(peerURL(addr))
+			pr.Out.Header.Set(headerForwardedBy, k8s.PodName())
+		},
+		ErrorHandler: func(w http.ResponseWriter, _ *http.Request, err error) {
+			l.Error("Error forwarding request to replica", slog.String(loggingKeyError, err.Error()))
+			uhttp.MustEncode(w, http.StatusBadGateway, uhttp.NewHTTPError(http.StatusBadGateway, err))
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// fetchPeerStatuses returns the statuses of the secrets owned by the replica at the given address,
+// keyed by cluster and namespace/name, or by file path. The request is authorized with the
+// Authorization header of the request being served.
+func fetchPeerStatuses(ctx context.Context, addr, authorization string) (map[string]secretStatus, error) {
+	if addr == "" {
+		return nil, ErrOwnerUnknown
+	}
+
+	u := peerURL(addr)
+	u.Path = "/v1/secrets"
+	u.RawQuery = url.Values{queryParamScope: []string{scopeLocal}}.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), http.NoBody)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set(headerForwardedBy, k8s.PodName())
+	req.Header.Set("Authorization", authorization)
+
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting statuses: %w", err)
+	}
+	defer resp.Body.Close() // nolint:errcheck // Nothing to do with the error
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code from replica: %d", resp.StatusCode)
+	}
+
+	list := new(secretList)
+	if err := uhttp.DecodeJSON(resp.Body, list); err != nil {
+		return nil, fmt.Errorf("error decoding statuses: %w", err)
+	}
+
+	statuses := make(map[string]secretStatus, len(list.Secrets))
+	for _, st := range list.Secrets {
+		statuses[st.key()] = st
+	}
+	return statuses, nil
+}
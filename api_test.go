@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestBearerAuth(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("api-token\n"), 0o600); err != nil {
+		t.Fatalf("writing token file: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		tokenFile     string
+		authorization string
+		want          int
+	}{
+		{
+			name:          "valid token",
+			tokenFile:     tokenFile,
+			authorization: "Bearer api-token",
+			want:          http.StatusOK,
+		},
+		{
+			name:          "invalid token",
+			tokenFile:     tokenFile,
+			authorization: "Bearer other-token",
+			want:          http.StatusUnauthorized,
+		},
+		{
+			name:          "other scheme",
+			tokenFile:     tokenFile,
+			authorization: "Basic api-token",
+			want:          http.StatusUnauthorized,
+		},
+		{
+			name:      "no token",
+			tokenFile: tokenFile,
+			want:      http.StatusUnauthorized,
+		},
+		{
+			name:          "missing token file",
+			tokenFile:     filepath.Join(t.TempDir(), "missing"),
+			authorization: "Bearer api-token",
+			want:          http.StatusServiceUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := bearerAuth(slog.New(slog.DiscardHandler), tt.tokenFile)(http.HandlerFunc(
+				func(w http.ResponseWriter, _ *http.Request) {
+					w.WriteHeader(http.StatusOK)
+				},
+			))
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/secrets/app/db/sync", http.NoBody)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPIHandlers(t *testing.T) {
+	ctx := t.Context()
+	l := slog.New(slog.DiscardHandler)
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("api-token"), 0o600); err != nil {
+		t.Fatalf("writing token file: %v", err)
+	}
+
+	vault := newFakeVault(t)
+	vault.put("secret", "app", map[string]any{"password": "hunter2"})
+
+	kubeClient := fake.NewClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}})
+	factory := newInformers(kubeClient)
+	factory.Start(ctx.Done())
+	for informerType, synced := range factory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			t.Fatalf("failed to sync %s informer cache", informerType)
+		}
+	}
+
+	secret := &Secret{Mount: "secret", Name: "app", DestinationNamespace: "default", DestinationName: "app"}
+	a := &App{
+		config:         new(atomic.Pointer[AppConfig]),
+		status:         newStatusStore(),
+		owners:         localOwnership{},
+		kubeClient:     kubeClient,
+		informers:      factory,
+		vaults:         newVaultClients(ctx, l, map[string]*vaultConfig{"": vault.config(t)}),
+		hasher:         newContentHasher(nil, 1),
+		pendingReloads: newPendingReloads(),
+	}
+	a.config.Store(&AppConfig{Secrets: []*Secret{secret}})
+	router := a.apiRouter(l, tokenFile)
+
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, target, http.NoBody)
+		req.Header.Set("Authorization", "Bearer api-token")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := serve(http.MethodPost, "/v1/secrets/default/missing/sync"); rec.Code != http.StatusNotFound {
+		t.Errorf("syncing an unknown secret: status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if rec := serve(http.MethodPost, "/v1/secrets/default/app/pin?version=0"); rec.Code != http.StatusBadRequest {
+		t.Errorf("pinning to version 0: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	rec := serve(http.MethodPost, "/v1/secrets/default/app/sync")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("syncing secret: status = %d, body %s", rec.Code, rec.Body)
+	}
+	got, err := kubeClient.CoreV1().Secrets("default").Get(ctx, "app", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("forced sync did not create the secret: %v", err)
+	} else if string(got.Data["password"]) != "hunter2" {
+		t.Errorf("password = %q, want the vault value", got.Data["password"])
+	}
+
+	rec = serve(http.MethodGet, "/v1/secrets")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("listing secrets: status = %d, body %s", rec.Code, rec.Body)
+	}
+	list := new(secretList)
+	if err := json.NewDecoder(rec.Body).Decode(list); err != nil {
+		t.Fatalf("decoding secret list: %v", err)
+	} else if len(list.Secrets) != 1 {
+		t.Fatalf("listed %d secrets, want 1", len(list.Secrets))
+	}
+	if st := list.Secrets[0]; st.Name != "app" || st.VaultVersion != 1 || st.LastSync.IsZero() || st.LastError != "" {
+		t.Errorf("status = %+v, want the forced sync of app", st)
+	}
+}
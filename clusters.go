@@ -0,0 +1,596 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jacobbrewer1/vaulty"
+	"github.com/jacobbrewer1/web/health"
+	"github.com/jacobbrewer1/web/k8s"
+	"github.com/jacobbrewer1/web/logging"
+	"github.com/spf13/viper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	// localClusterName is the name the cluster secret-sync connects to by default is selected and
+	// reported as.
+	localClusterName = "local"
+
+	// defaultKubeconfigKey is the key of the Kubernetes Secret, or the field of the vault secret,
+	// holding a cluster's kubeconfig.
+	defaultKubeconfigKey = "kubeconfig"
+
+	// clusterConnectTimeout is how long to wait for a cluster's informer caches to sync.
+	clusterConnectTimeout = 30 * time.Second
+
+	// clusterRetryInterval is the minimum time between two attempts to connect to a cluster.
+	clusterRetryInterval = 30 * time.Second
+)
+
+var (
+	ErrUnknownCluster        = errors.New("unknown cluster")
+	ErrClusterNotReady       = errors.New("cluster is not connected")
+	ErrInvalidClusterPattern = errors.New("invalid cluster pattern")
+	ErrKubeconfigSource      = errors.New("set one of kubeconfig_secret or kubeconfig_mount and kubeconfig_name")
+	ErrInvalidKubeconfig     = errors.New("invalid kubeconfig")
+)
+
+// clusterConfig is a remote cluster from the clusters config, and where to find its kubeconfig.
+type clusterConfig struct {
+	// KubeconfigSecret is the namespace/name of a Kubernetes Secret in the local cluster holding the
+	// kubeconfig. The namespace defaults to the namespace secret-sync is deployed in.
+	KubeconfigSecret string `mapstructure:"kubeconfig_secret"`
+
+	// KubeconfigVault, KubeconfigMount and KubeconfigName locate a vault secret holding the
+	// kubeconfig. The default vault is used if KubeconfigVault is empty.
+	KubeconfigVault string `mapstructure:"kubeconfig_vault"`
+	KubeconfigMount string `mapstructure:"kubeconfig_mount"`
+	KubeconfigName  string `mapstructure:"kubeconfig_name"`
+
+	// KubeconfigKey is the key of the Kubernetes Secret, or the field of the vault secret, holding
+	// the kubeconfig.
+	KubeconfigKey string `mapstructure:"kubeconfig_key"`
+
+	// Context is the kubeconfig context to use, the current context if empty.
+	Context string `mapstructure:"context"`
+}
+
+// Valid returns every problem with the cluster config.
+func (c *clusterConfig) Valid() error {
+	fromSecret := c.KubeconfigSecret != ""
+	fromVault := c.KubeconfigMount != "" || c.KubeconfigName != ""
+	switch {
+	case fromSecret && !fromVault:
+	case !fromSecret && c.KubeconfigMount != "" && c.KubeconfigName != "":
+	default:
+		return ErrKubeconfigSource
+	}
+	return nil
+}
+
+// kubeconfigKey returns the key holding the kubeconfig.
+func (c *clusterConfig) kubeconfigKey() string {
+	if c.KubeconfigKey == "" {
+		return defaultKubeconfigKey
+	}
+	return c.KubeconfigKey
+}
+
+// kubeCluster is a connected remote cluster.
+type kubeCluster struct {
+	kubeClient kubernetes.Interface
+	informers  informers.SharedInformerFactory
+	sources    *sourceInformers
+	reload     *reloader
+}
+
+// clusterConnector connects to the named cluster. The cluster is closed when ctx is cancelled.
+type clusterConnector func(ctx context.Context, name string, cfg *clusterConfig) (*kubeCluster, error)
+
+// kubeClusters holds the connections to every remote cluster. Clusters are connected in the
+// background, so that a cluster that cannot be reached only holds up the secrets synced into it.
+type kubeClusters struct {
+	mut *sync.Mutex
+
+	// ctx outlives every cluster, it stops their informers.
+	ctx     context.Context
+	l       *slog.Logger
+	connect clusterConnector
+
+	configs  map[string]*clusterConfig
+	clusters map[string]*kubeCluster
+
+	// cancels stop the informers of each connected cluster.
+	cancels map[string]context.CancelFunc
+
+	// attempts holds when each cluster was last tried, and pending is closed when the attempt ends.
+	attempts map[string]time.Time
+	pending  map[string]chan struct{}
+
+	// errs holds the last error connecting to each cluster, reported by the cluster's health check.
+	errs map[string]error
+
+	// watchers are called with every cluster once it is connected.
+	watchers []func(name string, c *kubeCluster)
+}
+
+func newKubeClusters(
+	ctx context.Context,
+	l *slog.Logger,
+	configs map[string]*clusterConfig,
+	connect clusterConnector,
+) *kubeClusters {
+	return &kubeClusters{
+		mut:      new(sync.Mutex),
+		ctx:      ctx,
+		l:        l,
+		connect:  connect,
+		configs:  configs,
+		clusters: make(map[string]*kubeCluster),
+		cancels:  make(map[string]context.CancelFunc),
+		attempts: make(map[string]time.Time),
+		pending:  make(map[string]chan struct{}),
+		errs:     make(map[string]error),
+		watchers: make([]func(string, *kubeCluster), 0),
+	}
+}
+
+// get returns the named cluster if it is connected. Otherwise a connection is attempted in the
+// background, at most once per clusterRetryInterval, and ErrClusterNotReady is returned.
+func (k *kubeClusters) get(name string) (*kubeCluster, error) {
+	k.mut.Lock()
+	defer k.mut.Unlock()
+
+	if c, ok := k.clusters[name]; ok {
+		return c, nil
+	} else if _, ok := k.configs[name]; !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownCluster, name)
+	}
+
+	if time.Since(k.attempts[name]) >= clusterRetryInterval {
+		k.start(name)
+	}
+
+	if err := k.errs[name]; err != nil {
+		return nil, fmt.Errorf("%w: %q: %w", ErrClusterNotReady, name, err)
+	}
+	return nil, fmt.Errorf("%w: %q", ErrClusterNotReady, name)
+}
+
+// connectAll attempts to connect to every cluster that is not connected, and waits for the attempts
+// to end. Clusters that cannot be reached are reported by their health check and retried later.
+func (k *kubeClusters) connectAll() {
+	k.mut.Lock()
+	waits := make([]chan struct{}, 0, len(k.configs))
+	for name := range k.configs {
+		if _, ok := k.clusters[name]; !ok {
+			waits = append(waits, k.start(name))
+		}
+	}
+	k.mut.Unlock()
+
+	for _, done := range waits {
+		<-done
+	}
+}
+
+// start begins connecting to the named cluster, unless an attempt is already running, and returns
+// a channel closed when the attempt ends. It must be called with the lock held.
+func (k *kubeClusters) start(name string) chan struct{} {
+	if done, ok := k.pending[name]; ok {
+		return done
+	}
+
+	done := make(chan struct{})
+	k.pending[name] = done
+	k.attempts[name] = time.Now()
+	cfg := *k.configs[name]
+
+	go func() {
+		defer close(done)
+
+		l := k.l.With(slog.String(loggingKeyCluster, name))
+		ctx, cancel := context.WithCancel(k.ctx)
+		c, err := k.connect(ctx, name, &cfg)
+
+		k.mut.Lock()
+		delete(k.pending, name)
+		if current, ok := k.configs[name]; err == nil && (!ok || *current != cfg) {
+			// The cluster was changed or removed by a config reload while connecting.
+			err = fmt.Errorf("%w: %q: config changed while connecting", ErrClusterNotReady, name)
+		}
+		if err != nil {
+			k.errs[name] = err
+			k.mut.Unlock()
+
+			cancel()
+			l.Error("Error connecting to cluster", slog.String(loggingKeyError, err.Error()))
+			return
+		}
+
+		delete(k.errs, name)
+		k.clusters[name] = c
+		k.cancels[name] = cancel
+		watchers := k.watchers
+		k.mut.Unlock()
+
+		l.Info("Cluster connected")
+		for _, watch := range watchers {
+			watch(name, c)
+		}
+	}()
+	return done
+}
+
+// watch calls fn with every connected cluster, and with every cluster connected from now on.
+func (k *kubeClusters) watch(fn func(name string, c *kubeCluster)) {
+	k.mut.Lock()
+	k.watchers = append(k.watchers, fn)
+	k.mut.Unlock()
+
+	for name, c := range k.connected() {
+		fn(name, c)
+	}
+}
+
+// connected returns every connected cluster.
+func (k *kubeClusters) connected() map[string]*kubeCluster {
+	k.mut.Lock()
+	defer k.mut.Unlock()
+
+	connected := make(map[string]*kubeCluster, len(k.clusters))
+	for name, c := range k.clusters {
+		connected[name] = c
+	}
+	return connected
+}
+
+// update replaces the cluster configs after a config reload. Clusters that were removed or changed
+// are closed, and connected again when next used.
+func (k *kubeClusters) update(configs map[string]*clusterConfig) {
+	k.mut.Lock()
+	defer k.mut.Unlock()
+
+	for name, current := range k.configs {
+		if next, ok := configs[name]; ok && *next == *current {
+			continue
+		}
+
+		// Connect with the new config straight away.
+		delete(k.attempts, name)
+
+		cancel, ok := k.cancels[name]
+		if !ok {
+			continue
+		}
+
+		cancel()
+		delete(k.clusters, name)
+		delete(k.cancels, name)
+		k.l.Info("Cluster closed", slog.String(loggingKeyCluster, name))
+	}
+
+	clear(k.errs)
+	k.configs = configs
+}
+
+// names returns the name of every remote cluster.
+func (k *kubeClusters) names() []string {
+	k.mut.Lock()
+	defer k.mut.Unlock()
+	return sortedKeys(k.configs)
+}
+
+// healthCheck reports whether the named cluster is connected and its API server is ready.
+func (k *kubeClusters) healthCheck(name string) health.CheckFunc {
+	return func(ctx context.Context) error {
+		k.mut.Lock()
+		c, connected := k.clusters[name]
+		err := k.errs[name]
+		_, configured := k.configs[name]
+		k.mut.Unlock()
+
+		switch {
+		case !configured:
+			// Removed by a config reload.
+			return nil
+		case err != nil:
+			return err
+		case !connected:
+			return ErrClusterNotReady
+		}
+
+		if err := c.kubeClient.Discovery().RESTClient().Get().AbsPath("/readyz").Do(ctx).Error(); err != nil {
+			return fmt.Errorf("error checking cluster health: %w", err)
+		}
+		return nil
+	}
+}
+
+// clusterHealthCheck returns a health check of every remote cluster. The clusters are listed on
+// every check, so that clusters added or removed by a config reload are checked without registering
+// the check again.
+func (a *App) clusterHealthCheck(l *slog.Logger) *health.Check {
+	return health.NewCheck(
+		"clusters",
+		func(ctx context.Context) error {
+			errs := make([]error, 0)
+			for _, name := range a.clusters.names() {
+				if err := a.clusters.healthCheck(name)(ctx); err != nil {
+					errs = append(errs, fmt.Errorf("cluster %s: %w", name, err))
+				}
+			}
+			return errors.Join(errs...)
+		},
+		health.WithCheckOnStatusChange(health.StandardStatusListener(l)),
+	)
+}
+
+// loadClusters sets up the connections to every remote cluster. If wait is set it waits for the
+// first attempt to connect to each of them, otherwise they connect in the background.
+func (a *App) loadClusters(wait bool) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		configs, err := parseClusters(a.base.Viper())
+		if err != nil {
+			return err
+		}
+
+		a.clusters = newKubeClusters(
+			ctx,
+			logging.LoggerWithComponent(a.base.Logger(), "clusters"),
+			configs,
+			a.connectCluster,
+		)
+
+		if wait {
+			a.clusters.connectAll()
+			return nil
+		}
+
+		// Secrets synced into a cluster that was not connected yet are synced as soon as it is.
+		a.clusters.watch(func(name string, _ *kubeCluster) {
+			secrets := make([]*Secret, 0)
+			for _, secret := range a.currentConfig().Secrets {
+				if secret.cluster == name {
+					secrets = append(secrets, secret)
+				}
+			}
+			if len(secrets) > 0 {
+				a.requestSync(a.clusters.l.With(slog.String(loggingKeyCluster, name)), secrets)
+			}
+		})
+		go a.clusters.connectAll()
+		return nil
+	}
+}
+
+// connectCluster loads the cluster's kubeconfig, connects to it and waits for its informer caches to
+// sync.
+func (a *App) connectCluster(ctx context.Context, name string, cfg *clusterConfig) (*kubeCluster, error) {
+	kubeconfig, err := a.readKubeconfig(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	apiConfig, err := clientcmd.Load(kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidKubeconfig, err)
+	}
+
+	restConfig, err := clientcmd.NewNonInteractiveClientConfig(
+		*apiConfig,
+		cfg.Context,
+		&clientcmd.ConfigOverrides{},
+		nil,
+	).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidKubeconfig, err)
+	}
+
+	kubeClient, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kube client: %w", err)
+	}
+
+	c := &kubeCluster{
+		kubeClient: kubeClient,
+		informers:  newInformers(kubeClient),
+		sources:    newSourceInformers(kubeClient),
+	}
+	c.informers.Start(ctx.Done())
+	c.sources.start(ctx)
+
+	syncCtx, cancel := context.WithTimeout(ctx, clusterConnectTimeout)
+	defer cancel()
+	for informerType, synced := range c.informers.WaitForCacheSync(syncCtx.Done()) {
+		if !synced {
+			return nil, fmt.Errorf("failed to sync %s informer cache", informerType)
+		}
+	}
+
+	if a.reloader != nil {
+		// Workloads are only restarted by the long running service.
+		c.reload = newReloader(
+			logging.LoggerWithComponent(a.base.Logger(), "reload-workloads").With(slog.String(loggingKeyCluster, name)),
+			kubeClient,
+			a.reloader.debounce,
+			a.reloader.minInterval,
+		)
+		go c.reload.run(ctx)
+	}
+	return c, nil
+}
+
+// readKubeconfig reads the cluster's kubeconfig from a Kubernetes Secret in the local cluster, or
+// from vault.
+func (a *App) readKubeconfig(ctx context.Context, cfg *clusterConfig) ([]byte, error) {
+	key := cfg.kubeconfigKey()
+
+	if cfg.KubeconfigSecret != "" && a.kubeClient == nil {
+		return nil, ErrKubernetesNotConnected
+	} else if cfg.KubeconfigSecret != "" {
+		namespace, name, ok := strings.Cut(cfg.KubeconfigSecret, "/")
+		if !ok {
+			namespace, name = k8s.DeployedNamespace(), cfg.KubeconfigSecret
+		}
+
+		secret, err := a.kubeClient.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("error getting kubeconfig secret: %w", err)
+		}
+
+		kubeconfig, ok := secret.Data[key]
+		if !ok {
+			return nil, fmt.Errorf("%w: secret %s/%s has no key %q", ErrInvalidKubeconfig, namespace, name, key)
+		}
+		return kubeconfig, nil
+	}
+
+	vaultClient, err := a.vaults.client(cfg.KubeconfigVault)
+	if err != nil {
+		return nil, err
+	}
+
+	vaultSecret, err := vaultClient.Path(cfg.KubeconfigName, vaulty.WithMount(cfg.KubeconfigMount)).GetKvSecretV2(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting kubeconfig from vault: %w", err)
+	}
+
+	kubeconfig, ok := vaultSecret.Data[key].(string)
+	if !ok {
+		return nil, fmt.Errorf("%w: field %q is not a string", ErrInvalidKubeconfig, key)
+	}
+	return []byte(kubeconfig), nil
+}
+
+// parseClusters reads and validates the remote clusters from the config.
+func parseClusters(vip *viper.Viper) (map[string]*clusterConfig, error) {
+	configs, err := decodeClusters(vip)
+	if err != nil {
+		return nil, err
+	}
+
+	if errs := validateClusters(configs); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid clusters: %w", errors.Join(errs...))
+	}
+	return configs, nil
+}
+
+// decodeClusters strictly decodes the remote clusters from the config, rejecting unknown fields.
+func decodeClusters(vip *viper.Viper) (map[string]*clusterConfig, error) {
+	configs := make(map[string]*clusterConfig)
+	if errs := decodeStrict(vip.Get("clusters"), &configs); len(errs) > 0 {
+		return nil, fmt.Errorf("error decoding clusters: %w", errors.Join(errs...))
+	}
+	return configs, nil
+}
+
+// validateClusters returns every problem with the remote clusters.
+func validateClusters(configs map[string]*clusterConfig) []error {
+	errs := make([]error, 0)
+	for _, name := range sortedKeys(configs) {
+		prefix := "clusters." + name
+		if name == localClusterName {
+			errs = append(errs, fmt.Errorf("%s: name is reserved for the cluster secret-sync connects to", prefix))
+			continue
+		} else if msgs := validation.IsDNS1123Label(name); len(msgs) > 0 {
+			errs = append(errs, fmt.Errorf("%s: name is not a valid DNS-1123 label: %s", prefix, strings.Join(msgs, "; ")))
+		}
+
+		if err := configs[name].Valid(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", prefix, err))
+		}
+	}
+	return errs
+}
+
+// validateClusterVaultRefs returns an error for every cluster whose kubeconfig is read from a vault
+// that is not configured.
+func validateClusterVaultRefs(configs map[string]*clusterConfig, vaults map[string]*vaultConfig) []error {
+	errs := make([]error, 0)
+	for _, name := range sortedKeys(configs) {
+		vault := configs[name].KubeconfigVault
+		if _, ok := vaults[vault]; !ok {
+			errs = append(errs, fmt.Errorf("clusters.%s: %w: %q", name, ErrUnknownVault, vault))
+		}
+	}
+	return errs
+}
+
+// validateClusterRefs returns an error for every cluster pattern of a secret that matches no
+// cluster.
+func validateClusterRefs(secrets []*Secret, configs map[string]*clusterConfig) []error {
+	names := clusterNames(configs)
+
+	errs := make([]error, 0)
+	for i, secret := range secrets {
+		if secret == nil {
+			continue
+		}
+
+		for _, pattern := range secret.Clusters {
+			if _, err := path.Match(pattern, ""); err != nil {
+				// Reported by the secret's validation.
+				continue
+			}
+
+			matched := false
+			for _, name := range names {
+				if ok, _ := path.Match(pattern, name); ok {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				errs = append(errs, fmt.Errorf("secrets[%d]: %w: %q", i, ErrUnknownCluster, pattern))
+			}
+		}
+	}
+	return errs
+}
+
+// clusterNames returns the name of every cluster secrets can be synced into, including the local
+// cluster.
+func clusterNames(configs map[string]*clusterConfig) []string {
+	names := []string{localClusterName}
+	for _, name := range sortedKeys(configs) {
+		if name != localClusterName {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// expandClusters returns a copy of every secret for each cluster it is synced into.
+func expandClusters(secrets []*Secret, configs map[string]*clusterConfig) []*Secret {
+	names := clusterNames(configs)
+
+	expanded := make([]*Secret, 0, len(secrets))
+	for _, secret := range secrets {
+		for _, cluster := range secret.targetClusters(names) {
+			target := *secret
+			target.cluster = cluster
+			expanded = append(expanded, &target)
+		}
+	}
+	return expanded
+}
+
+// clusterDisplayName returns the name the cluster is logged and reported as.
+func clusterDisplayName(name string) string {
+	if name == "" {
+		return localClusterName
+	}
+	return name
+}
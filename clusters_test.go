@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestClusterHealthCheckFollowsReload(t *testing.T) {
+	ctx := t.Context()
+	l := slog.New(slog.DiscardHandler)
+
+	unreachable := func(context.Context, string, *clusterConfig) (*kubeCluster, error) {
+		return nil, errors.New("connection refused")
+	}
+	a := &App{
+		clusters: newKubeClusters(ctx, l, make(map[string]*clusterConfig), unreachable),
+	}
+	check := a.clusterHealthCheck(l)
+
+	if err := check.Check(ctx); err != nil {
+		t.Fatalf("health check with no clusters failed: %v", err)
+	}
+
+	// A cluster added by a reload is checked.
+	a.clusters.update(map[string]*clusterConfig{"remote": {KubeconfigSecret: "default/remote"}})
+	if err := check.Check(ctx); err == nil || !strings.Contains(err.Error(), "cluster remote") {
+		t.Errorf("health check with an unreachable cluster = %v, want it to fail", err)
+	}
+
+	// A cluster removed by a reload no longer fails the check.
+	a.clusters.update(make(map[string]*clusterConfig))
+	if err := check.Check(ctx); err != nil {
+		t.Errorf("health check after removing the cluster failed: %v", err)
+	}
+}
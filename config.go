@@ -0,0 +1,108 @@
+package main
+
+import (
+	"log/slog"
+	"reflect"
+)
+
+// reloadConfig re-reads the secrets, vaults, clusters, policies, refresh interval and jitter after
+// the config file changes and swaps them in place. Removed secrets are cleaned up, and added and
+// changed secrets are handed to the sync loop to be synced straight away. If any part of the new config is invalid it is reported
+// and none of it is applied.
+func (a *App) reloadConfig(l *slog.Logger) {
+	vip := a.base.Viper()
+
+	cfg, err := parseConfig(vip)
+	if err != nil {
+		l.Error("Invalid config, keeping current config", slog.String(loggingKeyError, err.Error()))
+		return
+	}
+
+	interval, err := parseRefreshInterval(vip)
+	if err != nil {
+		l.Error("Invalid config, keeping current config", slog.String(loggingKeyError, err.Error()))
+		return
+	}
+
+	jitter, err := parseRefreshJitter(vip)
+	if err != nil {
+		l.Error("Invalid config, keeping current config", slog.String(loggingKeyError, err.Error()))
+		return
+	}
+
+	// Everything has been parsed and validated, so the new config is swapped in as a whole.
+	a.vaults.update(cfg.vaults)
+	a.clusters.update(cfg.clusters)
+
+	current := a.currentConfig()
+	next := *current
+	next.Secrets = cfg.secrets
+	next.syncInterval = interval
+	next.syncJitter = jitter
+	next.policies = cfg.policies
+	a.config.Store(&next)
+
+	select {
+	case a.configChanged <- struct{}{}:
+	default:
+		// A change is already pending, the scheduler reads the latest config.
+	}
+	a.watchSources(l)
+
+	changed, removed := compareSecrets(current.Secrets, next.Secrets)
+	l.Info("Config reloaded",
+		slog.Int(loggingKeyChanged, len(changed)),
+		slog.Int(loggingKeyRemoved, len(removed)),
+	)
+
+	ctx, cancel := a.base.ChildContext()
+	defer cancel()
+
+	hashBucket := a.hashBucket()
+	s := a.newSyncer()
+	for _, secret := range removed {
+		a.status.forget(secret)
+		recordPin(secret, 0)
+		if secret.File != nil {
+			s.removeSecret(ctx, l, secret, "removed from config")
+			continue
+		} else if !hashBucket.InBucket(secret.shardKey()) {
+			continue
+		}
+
+		cs, err := s.forCluster(secret.cluster)
+		if err != nil {
+			l.Error("Error removing secret", slog.String(loggingKeyError, err.Error()))
+			continue
+		}
+		cs.removeSecret(ctx, l, secret, "removed from config")
+	}
+
+	if len(changed) > 0 {
+		a.requestSync(l, changed)
+	}
+}
+
+// compareSecrets returns the secrets in next that are new or differ from current, and the secrets
+// in current whose destination is no longer configured.
+func compareSecrets(current, next []*Secret) (changed, removed []*Secret) {
+	currentByKey := make(map[string]*Secret, len(current))
+	for _, secret := range current {
+		currentByKey[secret.shardKey()] = secret
+	}
+
+	changed = make([]*Secret, 0)
+	for _, secret := range next {
+		key := secret.shardKey()
+		if old, ok := currentByKey[key]; !ok || !reflect.DeepEqual(old, secret) {
+			changed = append(changed, secret)
+		}
+		delete(currentByKey, key)
+	}
+
+	removed = make([]*Secret, 0, len(currentByKey))
+	for _, secret := range currentByKey {
+		removed = append(removed, secret)
+	}
+	return changed, removed
+}
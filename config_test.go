@@ -0,0 +1,112 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jacobbrewer1/web"
+)
+
+func TestReloadConfig(t *testing.T) {
+	ctx := t.Context()
+	l := slog.New(slog.DiscardHandler)
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig := func(config string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+			t.Fatalf("writing config: %v", err)
+		}
+	}
+	writeConfig(`
+refresh_interval: 1m
+secrets:
+  - mount: secret
+    name: app
+    destination_namespace: default
+    destination_name: app
+`)
+	t.Setenv("CONFIG_LOCATION", path)
+
+	base, err := web.NewApp(l)
+	if err != nil {
+		t.Fatalf("creating web app: %v", err)
+	} else if err := web.WithViperConfig()(base); err != nil {
+		t.Fatalf("reading config: %v", err)
+	}
+
+	a := &App{
+		config:           new(atomic.Pointer[AppConfig]),
+		configChanged:    make(chan struct{}, 1),
+		syncRequests:     make(chan []*Secret, syncRequestBuffer),
+		base:             base,
+		status:           newStatusStore(),
+		coordinationMode: coordinationModeNone,
+		pendingReloads:   newPendingReloads(),
+	}
+	a.config.Store(new(AppConfig))
+
+	// No secret is read, so the vaults are never logged in to.
+	a.vaults = newVaultClients(ctx, l, make(map[string]*vaultConfig))
+	a.clusters = newKubeClusters(ctx, l, make(map[string]*clusterConfig), nil)
+	if err := a.loadConfig(ctx); err != nil {
+		t.Fatalf("loading config: %v", err)
+	}
+	initial := a.currentConfig()
+
+	// An invalid config is not applied.
+	writeConfig(`
+refresh_interval: never
+secrets: []
+`)
+	if err := base.Viper().ReadInConfig(); err != nil {
+		t.Fatalf("reading config: %v", err)
+	}
+	a.reloadConfig(l)
+	if a.currentConfig() != initial {
+		t.Error("invalid config was applied")
+	}
+
+	writeConfig(`
+refresh_interval: 2m
+secrets:
+  - mount: secret
+    name: app
+    destination_namespace: default
+    destination_name: app
+  - mount: secret
+    name: db
+    destination_namespace: default
+    destination_name: db
+`)
+	if err := base.Viper().ReadInConfig(); err != nil {
+		t.Fatalf("reading config: %v", err)
+	}
+	a.reloadConfig(l)
+
+	if got := a.currentConfig().syncInterval; got != 2*time.Minute {
+		t.Errorf("refresh interval = %s, want 2m", got)
+	} else if got := initial.syncInterval; got != time.Minute {
+		t.Errorf("initial config was changed in place, refresh interval = %s", got)
+	}
+
+	select {
+	case <-a.configChanged:
+	default:
+		t.Error("schedule was not told about the config change")
+	}
+
+	// The added secret is handed to the sync loop, rather than synced by the reload.
+	select {
+	case secrets := <-a.syncRequests:
+		if len(secrets) != 1 || secrets[0].Name != "db" {
+			t.Errorf("sync request = %v, want the added secret", secrets)
+		}
+	default:
+		t.Error("added secret was not handed to the sync loop")
+	}
+}
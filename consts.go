@@ -3,11 +3,66 @@ package main
 const (
 	appName = "secret-sync"
 
-	loggingKeyError       = "err"
-	loggingKeyNamespace   = "namespace"
-	loggingKeyDestination = "destination"
-	loggingKeyInterval    = "interval"
+	commandServe    = "serve"
+	commandSync     = "sync"
+	commandDiff     = "diff"
+	commandValidate = "validate"
+
+	// coordinationModeHashBucket shards secrets between replicas by the service endpoints.
+	coordinationModeHashBucket = "hash-bucket"
+
+	// coordinationModeLeaderElection syncs every secret from the elected leader only.
+	coordinationModeLeaderElection = "leader-election"
+
+	// coordinationModeNone syncs every secret from every replica.
+	coordinationModeNone = "none"
+
+	exitCodeFailure = 1
+	exitCodeUsage   = 2
+
+	loggingKeyError          = "err"
+	loggingKeyNamespace      = "namespace"
+	loggingKeyDestination    = "destination"
+	loggingKeyInterval       = "interval"
+	loggingKeyOwner          = "owner"
+	loggingKeyWorkload       = "workload"
+	loggingKeyAction         = "action"
+	loggingKeyChange         = "change"
+	loggingKeyChanged        = "changed"
+	loggingKeyRemoved        = "removed"
+	loggingKeyReason         = "reason"
+	loggingKeyExclusive      = "exclusive"
+	loggingKeyMode           = "mode"
+	loggingKeyNextSync       = "next_sync"
+	loggingKeyCount          = "count"
+	loggingKeyPath           = "path"
+	loggingKeyVersion        = "version"
+	loggingKeyVault          = "vault"
+	loggingKeyRole           = "role"
+	loggingKeyVaultNamespace = "vault_namespace"
+	loggingKeyContext        = "context"
+	loggingKeyHost           = "host"
+	loggingKeyCluster        = "cluster"
 
 	secretAnnotationSyncIdKey = "vault-sync-id" // nolint:gosec // This is not a credential
 	secretLabelManagedBy      = "managed-by"
+
+	// secretAnnotationSource records the vault mount and path a secret was synced from.
+	secretAnnotationSource = "vault-sync-source"
+
+	// secretAnnotationPinVersion is set on a managed secret to hold it at the given vault version.
+	secretAnnotationPinVersion = "secret-sync/pin-version"
+
+	// secretAnnotationPaused is set to true on a managed secret to stop secret-sync writing to it.
+	secretAnnotationPaused = "secret-sync/paused"
+
+	// secretAnnotationForceSync is set on a managed secret, usually to a timestamp, to sync it
+	// straight away whenever the value changes.
+	secretAnnotationForceSync = "secret-sync/force-sync"
+
+	// workloadAnnotationReload lists the secrets, comma separated, whose changes should restart a workload.
+	workloadAnnotationReload = "secret-sync/reload"
+
+	// podTemplateAnnotationChecksum is set on the pod template of reloaded workloads to trigger a rollout.
+	podTemplateAnnotationChecksum = "secret-sync/checksum"
 )
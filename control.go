@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+
+	"github.com/jacobbrewer1/web/cache"
+	corev1 "k8s.io/api/core/v1"
+	coreErr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// controlAnnotations are set on managed Secrets by operators to control how they are synced. They
+// are kept when secret-sync updates the Secret, and the Secret is synced straight away when any of
+// them change.
+var controlAnnotations = []string{
+	secretAnnotationPinVersion,
+	secretAnnotationPaused,
+	secretAnnotationForceSync,
+}
+
+// pausedAnnotation reports whether the Kubernetes Secret is managed by secret-sync and paused.
+func pausedAnnotation(secret *corev1.Secret) bool {
+	if !managedSelector.Matches(labels.Set(secret.Labels)) {
+		return false
+	}
+
+	paused, _ := strconv.ParseBool(secret.Annotations[secretAnnotationPaused])
+	return paused
+}
+
+// paused reports whether the secret's destination is paused. It logs and records the change when
+// the secret is paused or resumed.
+func (s *syncer) paused(l *slog.Logger, secret *Secret) bool {
+	if secret.File != nil || secret.reverse() {
+		return false
+	}
+
+	paused := false
+	existing, err := s.secretLister.Secrets(secret.DestinationNamespace).Get(secret.DestinationName)
+	if err != nil && !coreErr.IsNotFound(err) {
+		l.Error("Error getting existing secret", slog.String(loggingKeyError, err.Error()))
+	} else if err == nil {
+		paused = pausedAnnotation(existing)
+	}
+
+	recordPaused(secret, paused)
+	if st, _ := s.status.get(secret); st.Paused != paused && paused {
+		l.Warn("Secret paused, skipping writes")
+	} else if st.Paused != paused {
+		l.Info("Secret resumed")
+	}
+	return paused
+}
+
+// controlChangedHandler syncs a managed Secret straight away when its control annotations change,
+// if it is the destination of a secret in the given cluster. The sync uses a syncer from syncers, so
+// that it follows config reloads.
+func controlChangedHandler(
+	ctx context.Context,
+	l *slog.Logger,
+	syncers func() (*syncer, error),
+	cluster string,
+	hashBucket cache.HashBucket,
+	secrets func() []*Secret,
+) func(any, any) {
+	return func(oldObj, newObj any) {
+		oldSecret, ok := oldObj.(*corev1.Secret)
+		if !ok {
+			return
+		}
+		newSecret, ok := newObj.(*corev1.Secret)
+		if !ok || !managedSelector.Matches(labels.Set(newSecret.Labels)) {
+			return
+		}
+
+		changed := false
+		for _, key := range controlAnnotations {
+			if oldSecret.Annotations[key] != newSecret.Annotations[key] {
+				changed = true
+			}
+		}
+		if !changed {
+			return
+		}
+
+		for _, secret := range secrets() {
+			if secret.reverse() || secret.File != nil || secret.cluster != cluster ||
+				secret.DestinationNamespace != newSecret.Namespace || secret.DestinationName != newSecret.Name {
+				continue
+			} else if !hashBucket.InBucket(secret.shardKey()) {
+				return
+			}
+
+			l := l.With(
+				slog.String(loggingKeyNamespace, secret.DestinationNamespace),
+				slog.String(loggingKeyDestination, secret.DestinationName),
+			)
+			l.Debug("Control annotations changed, syncing secret")
+
+			s, err := syncers()
+			if err != nil {
+				l.Error("Error syncing secret", slog.String(loggingKeyError, err.Error()))
+				return
+			}
+
+			res, err := s.upsertFromVault(ctx, l, secret)
+			s.status.record(secret, res, err)
+			s.logPlan(l)
+			return
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jacobbrewer1/web"
+	"github.com/jacobbrewer1/web/cache"
+	"github.com/jacobbrewer1/web/k8s"
+	coordinationlisters "k8s.io/client-go/listers/coordination/v1"
+)
+
+var ErrUnknownCoordinationMode = errors.New("unknown coordination mode")
+
+// Ensures that the owners implement the ownership interface.
+var (
+	_ ownership = new(endpointRing)
+	_ ownership = new(leaderOwnership)
+	_ ownership = localOwnership{}
+)
+
+// ownership resolves the replica that owns a key.
+type ownership interface {
+	// Owner returns the name of the pod that owns the given key and the address it can be reached on.
+	Owner(key string) (pod, address string)
+
+	// IsLocal reports whether the given pod is this replica.
+	IsLocal(pod string) bool
+}
+
+// leaderOwnership assigns every key to the current leader.
+type leaderOwnership struct {
+	ring     *endpointRing
+	leases   coordinationlisters.LeaseLister
+	lockName string
+}
+
+// newLeaderOwnership returns the ownership for leader election. The lease is watched by the ring's
+// informers, so it must be created before the ring is started.
+func newLeaderOwnership(ring *endpointRing, lockName string) *leaderOwnership {
+	return &leaderOwnership{
+		ring:     ring,
+		leases:   ring.informerFactory.Coordination().V1().Leases().Lister(),
+		lockName: lockName,
+	}
+}
+
+func (o *leaderOwnership) Owner(string) (pod, address string) {
+	lease, err := o.leases.Leases(o.ring.appNamespace).Get(o.lockName)
+	if err != nil || lease.Spec.HolderIdentity == nil {
+		return "", ""
+	}
+
+	pod = *lease.Spec.HolderIdentity
+	return pod, o.ring.Address(pod)
+}
+
+func (o *leaderOwnership) IsLocal(pod string) bool {
+	return o.ring.IsLocal(pod)
+}
+
+// localOwnership assigns every key to this replica.
+type localOwnership struct{}
+
+func (localOwnership) Owner(string) (pod, address string) {
+	return k8s.PodName(), ""
+}
+
+func (localOwnership) IsLocal(string) bool {
+	return true
+}
+
+// Ensures that the buckets implement the HashBucket interface.
+var (
+	_ cache.HashBucket = new(endpointRing)
+	_ cache.HashBucket = leaderBucket{}
+)
+
+// leaderBucket is a hash bucket that owns every key while this replica is the leader.
+type leaderBucket struct {
+	base *web.App
+}
+
+func (b leaderBucket) InBucket(string) bool {
+	return b.base.IsLeader()
+}
+
+// coordinationOptions returns the start options that set up the configured coordination mode.
+func (a *App) coordinationOptions() web.StartOption {
+	return func(base *web.App) error {
+		vip := base.Viper()
+		vip.SetDefault("coordination_mode", coordinationModeHashBucket)
+		if a.outOfCluster {
+			vip.SetDefault("coordination_mode", coordinationModeNone)
+		}
+
+		a.coordinationMode = vip.GetString("coordination_mode")
+		if a.outOfCluster && a.coordinationMode != coordinationModeNone {
+			return fmt.Errorf("%w: %q", ErrCoordinationOutOfCluster, a.coordinationMode)
+		}
+
+		switch a.coordinationMode {
+		case coordinationModeHashBucket:
+			// The endpoint ring is the hash bucket, it is started with the ownership.
+			return nil
+		case coordinationModeLeaderElection:
+			return web.WithLeaderElection(appName)(base)
+		case coordinationModeNone:
+			return nil
+		default:
+			return fmt.Errorf("%w: %q", ErrUnknownCoordinationMode, a.coordinationMode)
+		}
+	}
+}
+
+// hashBucket returns the bucket deciding which secrets this replica syncs.
+func (a *App) hashBucket() cache.HashBucket {
+	switch a.coordinationMode {
+	case coordinationModeLeaderElection:
+		return leaderBucket{base: a.base}
+	case coordinationModeNone:
+		return allBucket{}
+	default:
+		return a.ring
+	}
+}
+
+// ringChanges returns a channel signalled when the replicas in the hash ring change, or nil when
+// work is not sharded by the ring.
+func (a *App) ringChanges() <-chan struct{} {
+	if a.coordinationMode != coordinationModeHashBucket || a.ring == nil {
+		return nil
+	}
+	return a.ring.Changes()
+}
+
+// newOwnership returns the ownership for the configured coordination mode.
+func (a *App) newOwnership(ring *endpointRing) ownership {
+	switch a.coordinationMode {
+	case coordinationModeLeaderElection:
+		return newLeaderOwnership(ring, appName)
+	case coordinationModeNone:
+		return localOwnership{}
+	default:
+		return ring
+	}
+}
+
+// secretOwner returns the replica that owns the secret and the address it can be reached on. Every
+// replica writes file destinations on its own host, so they are always owned by this replica.
+func (a *App) secretOwner(secret *Secret) (pod, address string) {
+	if secret.File != nil {
+		return localOwnership{}.Owner(secret.shardKey())
+	}
+	return a.owners.Owner(secret.shardKey())
+}
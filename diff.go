@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/jacobbrewer1/web"
+	"github.com/jacobbrewer1/web/logging"
+)
+
+type changeAction string
+
+const (
+	changeActionCreate    changeAction = "create"
+	changeActionUpdate    changeAction = "update"
+	changeActionDelete    changeAction = "delete"
+	changeActionUnchanged changeAction = "unchanged"
+
+	// changeActionConflict is a destination that exists but is not managed by secret-sync, so a sync
+	// would fail.
+	changeActionConflict changeAction = "conflict"
+)
+
+// secretChange is a change a sync would make to a Kubernetes Secret, or to a file when Path is set.
+// Only key names are recorded, never values.
+type secretChange struct {
+	Action    changeAction
+	Cluster   string
+	Namespace string
+	Name      string
+	Path      string
+	Added     []string
+	Removed   []string
+	Changed   []string
+
+	// Reason explains why a secret would be deleted.
+	Reason string
+
+	// hash is the content hash the secret would be annotated with.
+	hash string
+}
+
+// summary describes the change in a single line.
+func (c *secretChange) summary() string {
+	parts := make([]string, 0)
+	if len(c.Added) > 0 {
+		parts = append(parts, "added: "+strings.Join(c.Added, ", "))
+	}
+	if len(c.Removed) > 0 {
+		parts = append(parts, "removed: "+strings.Join(c.Removed, ", "))
+	}
+	if len(c.Changed) > 0 {
+		parts = append(parts, "changed: "+strings.Join(c.Changed, ", "))
+	}
+	if c.Reason != "" {
+		parts = append(parts, c.Reason)
+	}
+	if c.Action == changeActionUpdate && len(parts) == 0 {
+		parts = append(parts, "metadata changed")
+	}
+	return strings.Join(parts, "; ")
+}
+
+// changeSet collects the changes planned by a dry run.
+type changeSet struct {
+	mut   *sync.Mutex
+	items []*secretChange
+}
+
+func newChangeSet() *changeSet {
+	return &changeSet{
+		mut:   new(sync.Mutex),
+		items: make([]*secretChange, 0),
+	}
+}
+
+func (c *changeSet) add(change *secretChange) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.items = append(c.items, change)
+}
+
+// changes returns the planned changes and resets the set.
+func (c *changeSet) changes() []*secretChange {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	items := c.items
+	c.items = make([]*secretChange, 0)
+	return items
+}
+
+// Diff runs the full reconciliation of every configured secret without writing to Kubernetes and
+// writes the changes it would make to w.
+func (a *App) Diff(w io.Writer) error {
+	cfg := *a.currentConfig()
+	cfg.dryRun = true
+	a.config.Store(&cfg)
+
+	if err := a.base.Start(
+		web.WithMetricsEnabled(false),
+		web.WithViperConfig(),
+		web.WithDependencyBootstrap(a.loadVaults),
+		web.WithDependencyBootstrap(a.loadHasher),
+		a.kubeClientOption(),
+		web.WithDependencyBootstrap(a.startInformers),
+		web.WithDependencyBootstrap(a.loadSecrets),
+		web.WithDependencyBootstrap(a.loadClusters(true)),
+	); err != nil {
+		return fmt.Errorf("failed to start web app: %w", err)
+	}
+
+	ctx, cancel := a.base.ChildContext()
+	defer cancel()
+
+	s := a.newSyncer()
+	s.syncSecrets(
+		ctx,
+		logging.LoggerWithComponent(a.base.Logger(), "diff"),
+		allBucket{},
+		a.currentConfig().Secrets,
+	)
+
+	writeChanges(w, s.plan.changes())
+
+	errs := make([]error, 0)
+	for _, secret := range a.currentConfig().Secrets {
+		if st, _ := a.status.get(secret); st.LastError != "" {
+			errs = append(errs, fmt.Errorf("error planning %s: %s", st.key(), st.LastError))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// writeChanges writes the changes as a table.
+func writeChanges(w io.Writer, changes []*secretChange) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACTION\tCLUSTER\tNAMESPACE\tNAME\tDETAILS")
+	for _, change := range changes {
+		cluster, namespace, name := clusterDisplayName(change.Cluster), change.Namespace, change.Name
+		if change.Path != "" {
+			cluster, namespace, name = "file", "-", change.Path
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", change.Action, cluster, namespace, name, change.summary())
+	}
+	_ = tw.Flush()
+}
+
+// diffKeys compares the keys of two secrets' data.
+func diffKeys(oldData, newData map[string][]byte) (added, removed, changed []string) {
+	added, removed, changed = make([]string, 0), make([]string, 0), make([]string, 0)
+	for k, v := range newData {
+		oldValue, ok := oldData[k]
+		switch {
+		case !ok:
+			added = append(added, k)
+		case !bytes.Equal(oldValue, v):
+			changed = append(changed, k)
+		}
+	}
+	for k := range oldData {
+		if _, ok := newData[k]; !ok {
+			removed = append(removed, k)
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return added, removed, changed
+}
+
+func sortedKeys[V any](data map[string]V) []string {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
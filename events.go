@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	hashiVault "github.com/hashicorp/vault/api"
+	"github.com/jacobbrewer1/web"
+	"github.com/jacobbrewer1/web/logging"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// vaultEventsPath subscribes to every KV v2 event.
+	vaultEventsPath = "/v1/sys/events/subscribe/kv-v2/*"
+
+	// headerVaultToken carries the vault token on the websocket handshake.
+	headerVaultToken = "X-Vault-Token" // nolint:gosec // This is not a credential
+
+	// vaultEventsHandshakeTimeout bounds the websocket handshake with the event stream.
+	vaultEventsHandshakeTimeout = 30 * time.Second
+
+	// syncRequestBuffer is the number of event driven syncs that can wait for the sync loop. Events
+	// beyond this are dropped and picked up by polling.
+	syncRequestBuffer = 100
+)
+
+// vaultEvent is the part of a vault KV event notification needed to find the affected secret.
+type vaultEvent struct {
+	Data struct {
+		EventType string `json:"event_type"`
+		Event     struct {
+			Metadata struct {
+				Path string `json:"path"`
+			} `json:"metadata"`
+		} `json:"event"`
+		PluginInfo struct {
+			MountPath string `json:"mount_path"`
+		} `json:"plugin_info"`
+	} `json:"data"`
+}
+
+// vaultEventsOption registers a vault event listener for every vault when vault_events is enabled.
+func (a *App) vaultEventsOption() web.StartOption {
+	return func(base *web.App) error {
+		if !base.Viper().GetBool("vault_events") {
+			return nil
+		}
+
+		for _, name := range a.vaults.names() {
+			task := "vault-events"
+			if name != "" {
+				task += "-" + name
+			}
+
+			if err := web.WithIndefiniteAsyncTask(task, a.watchVaultEvents(
+				logging.LoggerWithComponent(base.Logger(), task),
+				name,
+			))(base); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// watchVaultEvents subscribes to the named vault's KV event stream and requests an immediate sync of
+// every configured secret affected by an event. It reconnects with backoff, while polling carries on.
+func (a *App) watchVaultEvents(
+	l *slog.Logger,
+	vault string,
+) web.AsyncTaskFunc {
+	return func(ctx context.Context) {
+		backoff := newEventsBackoff()
+		for {
+			err := a.receiveVaultEvents(ctx, l, vault, func() {
+				// Connected, start the backoff again on the next failure.
+				backoff = newEventsBackoff()
+			})
+			if ctx.Err() != nil {
+				l.Info("Stopping vault event listener")
+				return
+			}
+
+			delay := backoff.Step()
+			l.Warn("Vault event stream disconnected, reconnecting",
+				slog.String(loggingKeyError, err.Error()),
+				slog.String(loggingKeyInterval, delay.String()),
+			)
+
+			select {
+			case <-ctx.Done():
+				l.Info("Stopping vault event listener")
+				return
+			case <-time.After(delay):
+			}
+		}
+	}
+}
+
+// receiveVaultEvents connects to the event stream and handles events until the connection fails.
+func (a *App) receiveVaultEvents(ctx context.Context, l *slog.Logger, vault string, onConnect func()) error {
+	client, err := a.vaults.client(vault)
+	if err != nil {
+		return err
+	}
+	vaultClient := client.Client()
+
+	location, header, err := vaultEventsRequest(vaultClient.Address(), vaultClient.Token())
+	if err != nil {
+		return err
+	}
+
+	// Trust the same certificates, and subscribe in the same namespace, as the vault client.
+	dialer := &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: vaultEventsHandshakeTimeout,
+		TLSClientConfig:  vaultTLSConfig(vaultClient),
+	}
+	if ns := vaultNamespace(vaultClient); ns != "" {
+		header.Set(hashiVault.NamespaceHeaderName, ns)
+	}
+
+	conn, _, err := dialer.DialContext(ctx, location, header)
+	if err != nil {
+		return fmt.Errorf("error connecting to vault event stream: %w", err)
+	}
+	defer conn.Close() // nolint:errcheck // Nothing to do with the error
+
+	// Unblock the receive below when the application shuts down.
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+
+	l.Info("Connected to vault event stream")
+	onConnect()
+
+	for {
+		event := new(vaultEvent)
+		if err := conn.ReadJSON(event); err != nil {
+			return fmt.Errorf("error receiving vault event: %w", err)
+		}
+
+		mount := event.Data.PluginInfo.MountPath
+		path := event.Data.Event.Metadata.Path
+		secrets := secretsForVaultPath(a.currentConfig().Secrets, vault, mount, path)
+		if len(secrets) == 0 {
+			continue
+		}
+
+		l.Debug("Vault event received",
+			slog.String(loggingKeyAction, event.Data.EventType),
+			slog.String(loggingKeyPath, path),
+			slog.Int(loggingKeyCount, len(secrets)),
+		)
+		a.requestSync(l, secrets)
+	}
+}
+
+// requestSync asks the sync loop to sync the given secrets straight away. If the loop is too far
+// behind the request is dropped, and the secrets are synced when next due.
+func (a *App) requestSync(l *slog.Logger, secrets []*Secret) {
+	select {
+	case a.syncRequests <- secrets:
+	default:
+		l.Warn("Sync loop is busy, leaving sync to polling", slog.Int(loggingKeyCount, len(secrets)))
+	}
+}
+
+// vaultEventsRequest returns the websocket URL of the vault event stream at the given address, and
+// the headers to connect with.
+func vaultEventsRequest(address, token string) (string, http.Header, error) {
+	if token == "" {
+		return "", nil, errors.New("vault client has no token")
+	}
+
+	location, err := url.Parse(address)
+	if err != nil {
+		return "", nil, fmt.Errorf("error parsing vault address: %w", err)
+	}
+
+	switch location.Scheme {
+	case "https":
+		location.Scheme = "wss"
+	default:
+		location.Scheme = "ws"
+	}
+	location.Path = strings.TrimSuffix(location.Path, "/") + vaultEventsPath
+	location.RawQuery = url.Values{"json": []string{"true"}}.Encode()
+
+	header := make(http.Header)
+	header.Set(headerVaultToken, token)
+	return location.String(), header, nil
+}
+
+// secretsForVaultPath returns the configured secrets synced from the given KV v2 event path of the
+// named vault, such as "secret/data/app" on the "secret/" mount.
+func secretsForVaultPath(secrets []*Secret, vault, mount, path string) []*Secret {
+	mount = strings.Trim(mount, "/")
+	rest, ok := strings.CutPrefix(path, mount+"/")
+	if mount == "" || !ok {
+		return nil
+	}
+
+	// Drop the KV v2 API segment, such as data, metadata or destroy.
+	_, name, ok := strings.Cut(rest, "/")
+	if !ok {
+		return nil
+	}
+
+	matched := make([]*Secret, 0)
+	for _, secret := range secrets {
+		if secret.Vault != vault || secret.VaultNamespace != "" || secret.reverse() {
+			// Secrets in other vault namespaces are not on this event stream.
+			continue
+		} else if strings.Trim(secret.Mount, "/") == mount && strings.Trim(secret.Name, "/") == name {
+			matched = append(matched, secret)
+		}
+	}
+	return matched
+}
+
+func newEventsBackoff() *wait.Backoff {
+	return &wait.Backoff{
+		Duration: time.Second,
+		Factor:   2,
+		Jitter:   0.1,
+		Steps:    10,
+		Cap:      2 * time.Minute,
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWatchVaultEvents(t *testing.T) {
+	ctx := t.Context()
+	l := slog.New(slog.DiscardHandler)
+
+	vault := newFakeVault(t)
+	secret := &Secret{
+		Mount:                "secret",
+		Name:                 "app",
+		DestinationNamespace: "default",
+		DestinationName:      "app",
+	}
+
+	// Each connection sends an event for the configured secret, and one for a secret that is not
+	// configured, then drops the connection.
+	connects := make(chan time.Time, 10)
+	upgrader := websocket.Upgrader{}
+	vault.events = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get(headerVaultToken); got != "test-token" {
+			t.Errorf("event stream token = %q, want %q", got, "test-token")
+		} else if got := r.URL.Query().Get("json"); got != "true" {
+			t.Errorf("event stream json = %q, want %q", got, "true")
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrading event stream: %v", err)
+			return
+		}
+		defer conn.Close() // nolint:errcheck // Nothing to do with the error
+		connects <- time.Now()
+
+		for _, path := range []string{"secret/data/other", "secret/data/app"} {
+			event := new(vaultEvent)
+			event.Data.EventType = "kv-v2/data-write"
+			event.Data.Event.Metadata.Path = path
+			event.Data.PluginInfo.MountPath = "secret/"
+			if err := conn.WriteJSON(event); err != nil {
+				t.Errorf("writing event: %v", err)
+				return
+			}
+		}
+	})
+
+	a := &App{
+		config:       new(atomic.Pointer[AppConfig]),
+		syncRequests: make(chan []*Secret, syncRequestBuffer),
+		vaults:       newVaultClients(ctx, l, map[string]*vaultConfig{"": vault.config(t)}),
+	}
+	a.config.Store(&AppConfig{Secrets: []*Secret{secret}})
+
+	done := make(chan struct{})
+	watchCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		defer close(done)
+		a.watchVaultEvents(l, "")(watchCtx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	var first time.Time
+	for i := range 2 {
+		select {
+		case secrets := <-a.syncRequests:
+			if len(secrets) != 1 || secrets[0] != secret {
+				t.Fatalf("sync request %d = %v, want the configured secret", i, secrets)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("no sync request %d", i)
+		}
+
+		connected := <-connects
+		if i == 0 {
+			first = connected
+		} else if delay := connected.Sub(first); delay < newEventsBackoff().Duration {
+			t.Errorf("reconnected after %s, want at least %s", delay, newEventsBackoff().Duration)
+		}
+	}
+}
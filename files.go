@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	fileFormatDotenv = "dotenv"
+	fileFormatJSON   = "json"
+	fileFormatYAML   = "yaml"
+	fileFormatRaw    = "raw"
+
+	// defaultFileMode is the mode of written files when none is configured.
+	defaultFileMode = 0o600
+
+	// fileReloadTimeout is the maximum duration allowed for a reload command.
+	fileReloadTimeout = 30 * time.Second
+)
+
+var (
+	ErrFileOption        = errors.New("not supported with a file destination")
+	ErrInvalidFile       = errors.New("invalid file destination")
+	ErrUnknownFileFormat = errors.New("unknown file format")
+	ErrUnknownSignal     = errors.New("unknown reload signal")
+)
+
+// knownFileFormats are the formats a file destination can be written in.
+var knownFileFormats = sets.New(
+	fileFormatDotenv,
+	fileFormatJSON,
+	fileFormatYAML,
+	fileFormatRaw,
+)
+
+// reloadSignals are the signals a file destination can send to its consumer after a write, named
+// without the SIG prefix.
+var reloadSignals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+// dotenvKey matches the keys that can be written to a dotenv file.
+var dotenvKey = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// dotenvBareValue matches the values that can be written to a dotenv file without quotes.
+var dotenvBareValue = regexp.MustCompile(`^[A-Za-z0-9_./:@%+,=-]*$`)
+
+// fileDestination writes the secret to a file rather than a Kubernetes Secret, for consumers outside
+// of Kubernetes.
+type fileDestination struct {
+	Path string `mapstructure:"path"`
+
+	// Format is dotenv (default), json, yaml or raw. Raw writes the value of Key alone.
+	Format string `mapstructure:"format"`
+	Key    string `mapstructure:"key"`
+
+	// Mode is the octal file mode, 0600 by default.
+	Mode string `mapstructure:"mode"`
+
+	// Owner and Group are the user and group names or IDs to own the file. The file is owned by
+	// secret-sync's user if empty.
+	Owner string `mapstructure:"owner"`
+	Group string `mapstructure:"group"`
+
+	// ReloadCommand is run after the file is written.
+	ReloadCommand []string `mapstructure:"reload_command"`
+
+	// ReloadSignal is sent to the process in ReloadPIDFile after the file is written.
+	ReloadSignal  string `mapstructure:"reload_signal"`
+	ReloadPIDFile string `mapstructure:"reload_pid_file"`
+}
+
+// format returns the configured format.
+func (f *fileDestination) format() string {
+	if f.Format == "" {
+		return fileFormatDotenv
+	}
+	return f.Format
+}
+
+// mode returns the configured file mode.
+func (f *fileDestination) mode() (fs.FileMode, error) {
+	if f.Mode == "" {
+		return defaultFileMode, nil
+	}
+
+	mode, err := strconv.ParseUint(f.Mode, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("%w: mode %q is not an octal permission", ErrInvalidFile, f.Mode)
+	}
+	return fs.FileMode(mode), nil
+}
+
+// signal returns the configured reload signal, named with or without the SIG prefix.
+func (f *fileDestination) signal() (syscall.Signal, bool) {
+	sig, ok := reloadSignals[strings.TrimPrefix(strings.ToUpper(f.ReloadSignal), "SIG")]
+	return sig, ok
+}
+
+// Valid returns every problem with the file destination.
+func (f *fileDestination) Valid() error {
+	errs := make([]error, 0)
+	if f.Path == "" {
+		errs = append(errs, fmt.Errorf("%w: path is required", ErrInvalidFile))
+	} else if !filepath.IsAbs(f.Path) {
+		errs = append(errs, fmt.Errorf("%w: path %q is not absolute", ErrInvalidFile, f.Path))
+	}
+
+	switch {
+	case !knownFileFormats.Has(f.format()):
+		errs = append(errs, fmt.Errorf("%w: %q", ErrUnknownFileFormat, f.Format))
+	case f.format() == fileFormatRaw && f.Key == "":
+		errs = append(errs, fmt.Errorf("%w: key is required with format raw", ErrInvalidFile))
+	case f.format() != fileFormatRaw && f.Key != "":
+		errs = append(errs, fmt.Errorf("%w: key only applies to format raw", ErrInvalidFile))
+	}
+
+	if _, err := f.mode(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if f.ReloadSignal != "" {
+		if _, ok := f.signal(); !ok {
+			errs = append(errs, fmt.Errorf("%w: %q", ErrUnknownSignal, f.ReloadSignal))
+		}
+	}
+	if (f.ReloadSignal == "") != (f.ReloadPIDFile == "") {
+		errs = append(errs, fmt.Errorf("%w: reload_signal and reload_pid_file are set together", ErrInvalidFile))
+	}
+
+	return errors.Join(errs...)
+}
+
+// render returns the file content for the vault secret's data.
+func (f *fileDestination) render(value map[string]any) ([]byte, error) {
+	data := make(map[string]string, len(value))
+	for k, v := range value {
+		data[k] = fmt.Sprintf("%v", v)
+	}
+	if len(data) == 0 {
+		return nil, errors.New("no data found in secret")
+	}
+
+	switch f.format() {
+	case fileFormatRaw:
+		v, ok := data[f.Key]
+		if !ok {
+			return nil, fmt.Errorf("key %q not found in secret", f.Key)
+		}
+		return []byte(v), nil
+	case fileFormatJSON:
+		b, err := json.MarshalIndent(data, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("error marshalling secret data: %w", err)
+		}
+		return append(b, '\n'), nil
+	case fileFormatYAML:
+		b, err := yaml.Marshal(data)
+		if err != nil {
+			return nil, fmt.Errorf("error marshalling secret data: %w", err)
+		}
+		return b, nil
+	case fileFormatDotenv:
+		buf := new(bytes.Buffer)
+		for _, k := range sortedKeys(data) {
+			if !dotenvKey.MatchString(k) {
+				return nil, fmt.Errorf("key %q is not a valid dotenv name", k)
+			}
+			fmt.Fprintf(buf, "%s=%s\n", k, dotenvValue(data[k]))
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownFileFormat, f.Format)
+	}
+}
+
+// dotenvValue quotes the value for a dotenv file, unless it is safe to write bare.
+func dotenvValue(v string) string {
+	if dotenvBareValue.MatchString(v) {
+		return v
+	}
+	return `"` + strings.NewReplacer(
+		`\`, `\\`,
+		`"`, `\"`,
+		"\n", `\n`,
+		`$`, `\$`,
+	).Replace(v) + `"`
+}
+
+// ownership resolves the configured owner and group to IDs, with -1 for those not set.
+func (f *fileDestination) ownership() (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if f.Owner != "" {
+		if uid, err = strconv.Atoi(f.Owner); err != nil {
+			u, err := user.Lookup(f.Owner)
+			if err != nil {
+				return 0, 0, fmt.Errorf("error looking up owner: %w", err)
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+	}
+	if f.Group != "" {
+		if gid, err = strconv.Atoi(f.Group); err != nil {
+			g, err := user.LookupGroup(f.Group)
+			if err != nil {
+				return 0, 0, fmt.Errorf("error looking up group: %w", err)
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+	return uid, gid, nil
+}
+
+// compare returns the action needed to bring the file to the given content, mode and ownership,
+// and what differs when it must be updated.
+func (f *fileDestination) compare(content []byte, mode fs.FileMode, uid, gid int) (changeAction, string, error) {
+	info, err := os.Stat(f.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return changeActionCreate, "", nil
+	} else if err != nil {
+		return "", "", fmt.Errorf("error reading file: %w", err)
+	}
+
+	existing, err := os.ReadFile(f.Path)
+	if err != nil {
+		return "", "", fmt.Errorf("error reading file: %w", err)
+	}
+
+	switch stat, ok := info.Sys().(*syscall.Stat_t); {
+	case !bytes.Equal(existing, content):
+		return changeActionUpdate, "content changed", nil
+	case info.Mode().Perm() != mode:
+		return changeActionUpdate, fmt.Sprintf("mode changed from %04o", info.Mode().Perm()), nil
+	case ok && ((uid >= 0 && int(stat.Uid) != uid) || (gid >= 0 && int(stat.Gid) != gid)):
+		return changeActionUpdate, fmt.Sprintf("ownership changed from %d:%d", stat.Uid, stat.Gid), nil
+	}
+	return changeActionUnchanged, "", nil
+}
+
+// write atomically replaces the file with the content, by writing a temporary file in the same
+// directory and renaming it over the file.
+func (f *fileDestination) write(content []byte, mode fs.FileMode, uid, gid int) (err error) {
+	dir, base := filepath.Split(f.Path)
+	tmp, err := os.CreateTemp(dir, "."+base+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tmp.Close()
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err := tmp.Write(content); err != nil {
+		return fmt.Errorf("error writing temporary file: %w", err)
+	} else if err := tmp.Chmod(mode); err != nil {
+		return fmt.Errorf("error setting file mode: %w", err)
+	} else if err := tmp.Chown(uid, gid); err != nil {
+		return fmt.Errorf("error setting file ownership: %w", err)
+	} else if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("error syncing temporary file: %w", err)
+	} else if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error closing temporary file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), f.Path); err != nil {
+		return fmt.Errorf("error replacing file: %w", err)
+	}
+	return nil
+}
+
+// reload runs the reload command and sends the reload signal, if configured.
+func (f *fileDestination) reload(ctx context.Context) error {
+	if len(f.ReloadCommand) > 0 {
+		ctx, cancel := context.WithTimeout(ctx, fileReloadTimeout)
+		defer cancel()
+
+		out, err := exec.CommandContext(ctx, f.ReloadCommand[0], f.ReloadCommand[1:]...).CombinedOutput() // nolint:gosec // The command is configured by the operator
+		if err != nil {
+			return fmt.Errorf("error running reload command: %w: %s", err, bytes.TrimSpace(out))
+		}
+	}
+
+	if f.ReloadSignal != "" {
+		b, err := os.ReadFile(f.ReloadPIDFile)
+		if err != nil {
+			return fmt.Errorf("error reading pid file: %w", err)
+		}
+
+		pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		if err != nil || pid <= 0 {
+			return fmt.Errorf("invalid pid in %s", f.ReloadPIDFile)
+		}
+
+		sig, _ := f.signal()
+		if err := syscall.Kill(pid, sig); err != nil {
+			return fmt.Errorf("error sending %s to %d: %w", f.ReloadSignal, pid, err)
+		}
+	}
+	return nil
+}
+
+// remove deletes the file, if it exists.
+func (f *fileDestination) remove() error {
+	if err := os.Remove(f.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("error removing file: %w", err)
+	}
+	return nil
+}
+
+// pendingReloads are the paths of files that were written without their consumer being reloaded.
+// They outlive the syncers, so that a failed reload is retried by the next sync even though the file
+// is unchanged by then.
+type pendingReloads struct {
+	mut   *sync.Mutex
+	paths sets.Set[string]
+}
+
+func newPendingReloads() *pendingReloads {
+	return &pendingReloads{
+		mut:   new(sync.Mutex),
+		paths: sets.New[string](),
+	}
+}
+
+// add marks the consumer of the file as not reloaded.
+func (p *pendingReloads) add(path string) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	p.paths.Insert(path)
+}
+
+// done marks the consumer of the file as reloaded.
+func (p *pendingReloads) done(path string) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	p.paths.Delete(path)
+}
+
+// has reports whether the consumer of the file has not been reloaded since it was written.
+func (p *pendingReloads) has(path string) bool {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	return p.paths.Has(path)
+}
+
+// syncFile reads the secret from vault and writes it to its file, or plans the write when running
+// dry. The consumer is only reloaded when the file changes, or when its last reload failed.
+func (s *syncer) syncFile(ctx context.Context, l *slog.Logger, secret *Secret) (*syncResult, error) {
+	l = l.With(slog.String(loggingKeyPath, secret.File.Path))
+
+	vaultSecret, err := s.readFromVault(ctx, secret)
+	if errors.Is(err, ErrSourceDeleted) {
+		vaultSecret, err = s.sourceDeleted(ctx, l, secret, err)
+	}
+	if err != nil {
+		l.Error("Error getting secret from vault", slog.String(loggingKeyError, err.Error()))
+		return nil, fmt.Errorf("error getting secret from vault: %w", err)
+	}
+
+	content, err := secret.File.render(vaultSecret.Data)
+	if err != nil {
+		l.Error("Error rendering file", slog.String(loggingKeyError, err.Error()))
+		return nil, fmt.Errorf("error rendering file: %w", err)
+	}
+
+	mode, err := secret.File.mode()
+	if err != nil {
+		return nil, err
+	}
+
+	uid, gid, err := secret.File.ownership()
+	if err != nil {
+		return nil, err
+	}
+
+	res := &syncResult{
+		vaultVersion: vaultVersion(vaultSecret),
+		hash:         s.hasher.sum(content),
+	}
+
+	action, reason, err := secret.File.compare(content, mode, uid, gid)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.plan != nil {
+		s.plan.add(&secretChange{
+			Action: action,
+			Path:   secret.File.Path,
+			Reason: reason,
+			hash:   res.hash,
+		})
+		return res, nil
+	} else if action == changeActionUnchanged && !s.pendingReloads.has(secret.File.Path) {
+		return res, nil
+	}
+
+	if action != changeActionUnchanged {
+		if err := secret.File.write(content, mode, uid, gid); err != nil {
+			l.Error("Error writing file", slog.String(loggingKeyError, err.Error()))
+			return nil, err
+		}
+		l.Info("Secret written to file")
+		s.pendingReloads.add(secret.File.Path)
+	} else {
+		l.Info("Retrying reload of consumer")
+	}
+
+	if err := secret.File.reload(ctx); err != nil {
+		l.Error("Error reloading consumer", slog.String(loggingKeyError, err.Error()))
+		return nil, err
+	}
+	s.pendingReloads.done(secret.File.Path)
+	return res, nil
+}
+
+// removeFile deletes the file destination of a secret, or plans the deletion when running dry.
+func (s *syncer) removeFile(l *slog.Logger, secret *Secret, reason string) {
+	l = l.With(slog.String(loggingKeyPath, secret.File.Path))
+
+	if _, err := os.Stat(secret.File.Path); errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+
+	if s.plan != nil {
+		s.plan.add(&secretChange{
+			Action: changeActionDelete,
+			Path:   secret.File.Path,
+			Reason: reason,
+		})
+		return
+	}
+
+	if err := secret.File.remove(); err != nil {
+		l.Error("Error removing file", slog.String(loggingKeyError, err.Error()))
+		return
+	}
+	s.pendingReloads.done(secret.File.Path)
+	l.Warn("Audit: file deleted", slog.String(loggingKeyReason, reason))
+}
+
+// fileKey returns the key of a file destination.
+func fileKey(path string) string {
+	return "file:" + path
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSyncFileRetriesFailedReload(t *testing.T) {
+	ctx := t.Context()
+	l := slog.New(slog.DiscardHandler)
+	dir := t.TempDir()
+
+	vault := newFakeVault(t)
+	vault.put("secret", "app", map[string]any{"PASSWORD": "hunter2"})
+
+	// The reload fails until the ready file exists, and leaves the reloaded file behind once it
+	// succeeds.
+	ready := filepath.Join(dir, "ready")
+	reloaded := filepath.Join(dir, "reloaded")
+	secret := &Secret{
+		Mount: "secret",
+		Name:  "app",
+		File: &fileDestination{
+			Path:          filepath.Join(dir, "app.env"),
+			ReloadCommand: []string{"sh", "-c", `test -f "$0" && touch "$1"`, ready, reloaded},
+		},
+	}
+
+	s := &syncer{
+		vaults:         newVaultClients(ctx, l, map[string]*vaultConfig{"": vault.config(t)}),
+		hasher:         newContentHasher(nil, 1),
+		pendingReloads: newPendingReloads(),
+	}
+
+	if _, err := s.syncFile(ctx, l, secret); err == nil {
+		t.Fatal("first sync succeeded, want the reload to fail")
+	}
+
+	if err := os.WriteFile(ready, nil, 0o600); err != nil {
+		t.Fatalf("writing ready file: %v", err)
+	}
+	if _, err := s.syncFile(ctx, l, secret); err != nil {
+		t.Fatalf("second sync: %v", err)
+	}
+	if _, err := os.Stat(reloaded); err != nil {
+		t.Fatalf("consumer not reloaded after the file was left unchanged: %v", err)
+	}
+
+	// Once reloaded, an unchanged file does not reload the consumer again.
+	if err := os.Remove(reloaded); err != nil {
+		t.Fatalf("removing reloaded file: %v", err)
+	}
+	if _, err := s.syncFile(ctx, l, secret); err != nil {
+		t.Fatalf("third sync: %v", err)
+	}
+	if _, err := os.Stat(reloaded); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("consumer reloaded for an unchanged file, stat error: %v", err)
+	}
+}
+
+func TestSyncFileFormats(t *testing.T) {
+	tests := []struct {
+		name string
+		file fileDestination
+		want string
+		mode fs.FileMode
+	}{
+		{
+			name: "dotenv",
+			want: "PASSWORD=\"hunter 2\\$\"\nUSER=admin\n",
+			mode: defaultFileMode,
+		},
+		{
+			name: "json",
+			file: fileDestination{Format: fileFormatJSON, Mode: "0640"},
+			want: "{\n  \"PASSWORD\": \"hunter 2$\",\n  \"USER\": \"admin\"\n}\n",
+			mode: 0o640,
+		},
+		{
+			name: "yaml",
+			file: fileDestination{Format: fileFormatYAML},
+			want: "PASSWORD: hunter 2$\nUSER: admin\n",
+			mode: defaultFileMode,
+		},
+		{
+			name: "raw",
+			file: fileDestination{Format: fileFormatRaw, Key: "USER", Mode: "0444"},
+			want: "admin",
+			mode: 0o444,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := t.Context()
+			l := slog.New(slog.DiscardHandler)
+
+			vault := newFakeVault(t)
+			vault.put("secret", "app", map[string]any{"USER": "admin", "PASSWORD": "hunter 2$"})
+
+			file := tt.file
+			file.Path = filepath.Join(t.TempDir(), "app")
+			secret := &Secret{Mount: "secret", Name: "app", File: &file}
+			if err := file.Valid(); err != nil {
+				t.Fatalf("Valid() error = %v", err)
+			}
+
+			s := &syncer{
+				vaults:         newVaultClients(ctx, l, map[string]*vaultConfig{"": vault.config(t)}),
+				hasher:         newContentHasher(nil, 1),
+				pendingReloads: newPendingReloads(),
+			}
+			if _, err := s.syncFile(ctx, l, secret); err != nil {
+				t.Fatalf("syncFile() error = %v", err)
+			}
+
+			got, err := os.ReadFile(file.Path)
+			if err != nil {
+				t.Fatalf("reading file: %v", err)
+			} else if string(got) != tt.want {
+				t.Errorf("file content = %q, want %q", got, tt.want)
+			}
+
+			info, err := os.Stat(file.Path)
+			if err != nil {
+				t.Fatalf("stat file: %v", err)
+			} else if info.Mode().Perm() != tt.mode {
+				t.Errorf("file mode = %o, want %o", info.Mode().Perm(), tt.mode)
+			}
+		})
+	}
+}
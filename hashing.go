@@ -1,8 +1,50 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+	"time"
+
+	"github.com/jacobbrewer1/vaulty"
+	"github.com/spf13/viper"
+	"golang.org/x/time/rate"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+const (
+	// hashPrefixHMAC marks a sync annotation holding a keyed HMAC-SHA256. Annotations without a prefix
+	// hold a plain SHA-256.
+	hashPrefixHMAC = "hmac-sha256:"
+
+	// defaultHashingKeyField is the field of the vault secret holding the HMAC key.
+	defaultHashingKeyField = "key"
+
+	// defaultHashMigrationsPerMinute is how many secrets with a plain SHA-256 are rewritten with the
+	// HMAC each minute.
+	defaultHashMigrationsPerMinute = 60
+)
+
+var (
+	ErrInvalidHashingKey = errors.New("invalid hashing key")
+	ErrHashingKeySource  = errors.New("set one of hashing.key_file or hashing.key_mount and hashing.key_name")
+)
+
+// knownHashingKeys are the keys of the hashing configuration.
+var knownHashingKeys = sets.New(
+	"key_file",
+	"key_vault",
+	"key_mount",
+	"key_name",
+	"key_field",
+	"migrations_per_minute",
 )
 
 func shaHash(data []byte) string {
@@ -10,3 +52,122 @@ func shaHash(data []byte) string {
 	hasher.Write(data)
 	return hex.EncodeToString(hasher.Sum(nil))
 }
+
+// hmacHash returns the HMAC-SHA256 of the data under the key.
+func hmacHash(key, data []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// contentHasher computes the sync annotation of a secret's content. Without a key it records a plain
+// SHA-256, as before keys were supported. With a key it records a keyed HMAC, so that the
+// annotation cannot be used to guess the secret's data.
+type contentHasher struct {
+	key []byte
+
+	// migrations limits how fast secrets with a plain SHA-256 are rewritten with the HMAC, so that
+	// enabling a key does not update every secret at once.
+	migrations *rate.Limiter
+}
+
+func newContentHasher(key []byte, migrationsPerMinute int) *contentHasher {
+	return &contentHasher{
+		key:        key,
+		migrations: rate.NewLimiter(rate.Every(time.Minute/time.Duration(max(migrationsPerMinute, 1))), 1),
+	}
+}
+
+// sum returns the sync annotation for the content.
+func (h *contentHasher) sum(content []byte) string {
+	if h == nil || len(h.key) == 0 {
+		return shaHash(content)
+	}
+	return hashPrefixHMAC + hmacHash(h.key, content)
+}
+
+// matches reports whether the annotation was computed from the content, with the algorithm the
+// annotation records.
+func (h *contentHasher) matches(annotation string, content []byte) bool {
+	digest, ok := strings.CutPrefix(annotation, hashPrefixHMAC)
+	if !ok {
+		return hmac.Equal([]byte(annotation), []byte(shaHash(content)))
+	} else if h == nil || len(h.key) == 0 {
+		return false
+	}
+	return hmac.Equal([]byte(digest), []byte(hmacHash(h.key, content)))
+}
+
+// sameContent reports whether the existing Secret holds the same type and data as the new one. It
+// is used when the existing annotation does not match, as an annotation recorded under a previous
+// hashing key cannot be compared with one recorded under the current key.
+func sameContent(existing, next *corev1.Secret) bool {
+	return existing.Type == next.Type && maps.EqualFunc(existing.Data, next.Data, bytes.Equal)
+}
+
+// migrate reports whether an up to date annotation recorded with another algorithm may be rewritten
+// now.
+func (h *contentHasher) migrate() bool {
+	return h != nil && h.migrations.Allow()
+}
+
+// loadHasher sets up the hasher for sync annotations, with the key from a file or vault if one is
+// configured.
+func (a *App) loadHasher(ctx context.Context) error {
+	vip := a.base.Viper()
+	vip.SetDefault("hashing.key_field", defaultHashingKeyField)
+	vip.SetDefault("hashing.migrations_per_minute", defaultHashMigrationsPerMinute)
+
+	key, err := a.hashingKey(ctx, vip)
+	if err != nil {
+		return fmt.Errorf("error loading hashing key: %w", err)
+	}
+
+	if len(key) > 0 {
+		a.base.Logger().Info("Sync annotations are keyed with HMAC-SHA256")
+	}
+	a.hasher = newContentHasher(key, vip.GetInt("hashing.migrations_per_minute"))
+	return nil
+}
+
+// hashingKey reads the configured HMAC key, or returns nil if none is configured.
+func (a *App) hashingKey(ctx context.Context, vip *viper.Viper) ([]byte, error) {
+	keyFile := vip.GetString("hashing.key_file")
+	mount, name := vip.GetString("hashing.key_mount"), vip.GetString("hashing.key_name")
+
+	var key string
+	switch {
+	case keyFile == "" && mount == "" && name == "":
+		return nil, nil
+	case keyFile != "" && mount == "" && name == "":
+		k, err := readCredential(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		key = k
+	case keyFile == "" && mount != "" && name != "":
+		vaultClient, err := a.vaults.client(vip.GetString("hashing.key_vault"))
+		if err != nil {
+			return nil, err
+		}
+
+		vaultSecret, err := vaultClient.Path(name, vaulty.WithMount(mount)).GetKvSecretV2(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error getting key from vault: %w", err)
+		}
+
+		field := vip.GetString("hashing.key_field")
+		k, ok := vaultSecret.Data[field].(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: field %q is not a string", ErrInvalidHashingKey, field)
+		}
+		key = k
+	default:
+		return nil, ErrHashingKeySource
+	}
+
+	if len(key) < sha256.Size {
+		return nil, fmt.Errorf("%w: must be at least %d bytes", ErrInvalidHashingKey, sha256.Size)
+	}
+	return []byte(key), nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jacobbrewer1/web"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/informers"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	kubeCache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// informerResync is how often the informers resync their caches.
+const informerResync = 30 * time.Second
+
+// knownKubernetesKeys are the keys of the kubernetes configuration.
+var knownKubernetesKeys = sets.New(
+	"kubeconfig",
+	"context",
+)
+
+var (
+	ErrCoordinationOutOfCluster = errors.New("coordination between replicas needs in-cluster config, use coordination_mode none")
+	ErrKubernetesNotConnected   = errors.New("not connected to kubernetes as every secret was written to a file at startup")
+)
+
+// kubeOptions selects the cluster to connect to when running outside of it. Flags take precedence
+// over the kubernetes section of the config file.
+type kubeOptions struct {
+	kubeconfig string
+	context    string
+}
+
+// kubeClientOption connects to the cluster from the configured kubeconfig and context, or with the
+// in-cluster config if neither is set, and sets up the informers the sync loop reads from. Kubernetes
+// is not connected to at all if every secret is written to a file.
+func (a *App) kubeClientOption() web.StartOption {
+	return func(base *web.App) error {
+		vip := base.Viper()
+		kubeconfig := cmp.Or(a.kubeFlags.kubeconfig, vip.GetString("kubernetes.kubeconfig"))
+		kubeContext := cmp.Or(a.kubeFlags.context, vip.GetString("kubernetes.context"))
+
+		if kubeconfig == "" && kubeContext == "" && onlyFiles(vip.Get("secrets")) {
+			base.Logger().Info("Every secret is written to a file, not connecting to Kubernetes")
+			a.outOfCluster = true
+			return nil
+		} else if kubeconfig == "" && kubeContext == "" {
+			// The web library's client is also used for coordination between replicas.
+			if err := web.WithInClusterKubeClient()(base); err != nil {
+				return err
+			}
+			a.kubeClient = base.KubeClient()
+		} else {
+			cfg, err := kubeconfigRESTConfig(kubeconfig, kubeContext)
+			if err != nil {
+				return err
+			}
+
+			kubeClient, err := kubernetes.NewForConfig(cfg)
+			if err != nil {
+				return fmt.Errorf("failed to create kube client: %w", err)
+			}
+
+			base.Logger().Info("Using kubeconfig",
+				slog.String(loggingKeyPath, kubeconfig),
+				slog.String(loggingKeyContext, kubeContext),
+				slog.String(loggingKeyHost, cfg.Host),
+			)
+			a.kubeClient = kubeClient
+			a.outOfCluster = true
+		}
+
+		a.informers = newInformers(a.kubeClient)
+		a.sources = newSourceInformers(a.kubeClient)
+		return nil
+	}
+}
+
+// newInformers returns the informers the sync loop reads from. The Secret informer only holds the
+// Secrets managed by secret-sync, so that other Secrets are neither listed nor cached.
+func newInformers(kubeClient kubernetes.Interface) informers.SharedInformerFactory {
+	factory := informers.NewSharedInformerFactory(kubeClient, informerResync)
+	factory.InformerFor(&corev1.Secret{}, func(c kubernetes.Interface, resync time.Duration) kubeCache.SharedIndexInformer {
+		return coreinformers.NewFilteredSecretInformer(
+			c,
+			metav1.NamespaceAll,
+			resync,
+			kubeCache.Indexers{kubeCache.NamespaceIndex: kubeCache.MetaNamespaceIndexFunc},
+			func(opts *metav1.ListOptions) {
+				opts.LabelSelector = managedSelector.String()
+			},
+		)
+	})
+	factory.Core().V1().Namespaces().Informer()
+	return factory
+}
+
+// kubeconfigRESTConfig loads the client config from the kubeconfig file, or from the default
+// locations if it is empty, using the given context or the current context if it is empty.
+func kubeconfigRESTConfig(kubeconfig, kubeContext string) (*rest.Config, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if kubeconfig != "" {
+		rules.ExplicitPath = kubeconfig
+	}
+
+	cfg, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		rules,
+		&clientcmd.ConfigOverrides{CurrentContext: kubeContext},
+	).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubeconfig: %w", err)
+	}
+	return cfg, nil
+}
+
+// onlyFiles reports whether every configured secret is written to a file. Secrets that fail to
+// decode are reported when the secrets are loaded.
+func onlyFiles(raw any) bool {
+	secrets, errs := decodeSecrets(raw)
+	if len(errs) > 0 {
+		return false
+	}
+
+	for _, secret := range secrets {
+		if secret.File == nil {
+			return false
+		}
+	}
+	return true
+}
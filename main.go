@@ -3,24 +3,78 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/caarlos0/env/v10"
 	"github.com/jacobbrewer1/web"
+	"github.com/jacobbrewer1/web/k8s"
 	"github.com/jacobbrewer1/web/logging"
+	"github.com/spf13/viper"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
 )
 
 type (
 	AppConfig struct {
 		Secrets      []*Secret
 		syncInterval time.Duration
+
+		// syncJitter is the fraction of a secret's refresh interval added at random to each sync.
+		syncJitter float64
+
+		// dryRun plans changes without writing them to Kubernetes.
+		dryRun bool
+
+		// policies restrict which vault paths may be synced into which namespaces.
+		policies []*policy
 	}
 
 	App struct {
-		config *AppConfig
-		base   *web.App
+		// config is replaced as a whole when the config file changes, see reloadConfig.
+		config *atomic.Pointer[AppConfig]
+
+		// configChanged is signalled when the config is reloaded, so that the schedule is updated.
+		configChanged chan struct{}
+
+		schedule *schedule
+
+		// syncRequests carries secrets to sync straight away, such as those changed in vault.
+		syncRequests chan []*Secret
+
+		base     *web.App
+		vaults   *vaultClients
+		clusters *kubeClusters
+		hasher   *contentHasher
+		status   *statusStore
+		ring     *endpointRing
+		owners   ownership
+		reloader *reloader
+
+		// pendingReloads are the file destinations whose consumer has not been reloaded since they
+		// were written.
+		pendingReloads *pendingReloads
+
+		// kubeClient and informers reach the cluster secrets are synced into, and sources watch the
+		// Secrets pushed into vault.
+		kubeClient kubernetes.Interface
+		informers  informers.SharedInformerFactory
+		sources    *sourceInformers
+
+		// kubeFlags select a kubeconfig and context from the command line.
+		kubeFlags kubeOptions
+
+		// outOfCluster is set when connected with a kubeconfig rather than the in-cluster config, or
+		// when not connected to Kubernetes at all. kubeClient and informers are nil in the latter case.
+		outOfCluster bool
+
+		// coordinationMode decides how work is split between replicas.
+		coordinationMode string
 	}
 )
 
@@ -35,58 +89,104 @@ func NewApp(l *slog.Logger) (*App, error) {
 		return nil, fmt.Errorf("failed to parse environment: %w", err)
 	}
 
-	return &App{
-		config: config,
-		base:   base,
-	}, nil
+	app := &App{
+		config:        new(atomic.Pointer[AppConfig]),
+		configChanged: make(chan struct{}, 1),
+		schedule:      newSchedule(),
+		syncRequests:  make(chan []*Secret, syncRequestBuffer),
+		base:          base,
+		status:        newStatusStore(),
+
+		pendingReloads: newPendingReloads(),
+	}
+	app.config.Store(config)
+	return app, nil
+}
+
+// currentConfig returns the configuration in effect.
+func (a *App) currentConfig() *AppConfig {
+	return a.config.Load()
+}
+
+// refreshInterval returns the interval between syncs of the given secret.
+func (c *AppConfig) refreshInterval(secret *Secret) time.Duration {
+	if secret.RefreshInterval > 0 {
+		return secret.RefreshInterval
+	}
+	return c.syncInterval
 }
 
 func (a *App) Start() error {
 	if err := a.base.Start(
+		// The metrics are served by the api task, together with the operational API.
+		web.WithMetricsEnabled(false),
 		web.WithViperConfig(),
-		web.WithConfigWatchers(func() {
-			a.base.Shutdown()
-		}),
-		web.WithVaultClient(),
-		web.WithInClusterKubeClient(),
-		web.WithKubernetesSecretInformer(),
-		web.WithServiceEndpointHashBucket(appName),
+		web.WithDependencyBootstrap(a.loadVaults),
+		web.WithDependencyBootstrap(a.loadHasher),
+		a.kubeClientOption(),
+		web.WithDependencyBootstrap(a.startInformers),
+		a.coordinationOptions(),
 		web.WithDependencyBootstrap(func(ctx context.Context) error {
-			vip := a.base.Viper()
-			secrets := make([]*Secret, 0)
-			if err := vip.UnmarshalKey("secrets", &secrets); err != nil {
-				return fmt.Errorf("error unmarshalling secrets: %w", err)
-			} else if len(secrets) == 0 {
-				return errors.New("no secrets provided")
+			a.base.Logger().Info("Coordination mode set", slog.String(loggingKeyMode, a.coordinationMode))
+			if a.coordinationMode == coordinationModeNone {
+				// Every secret is synced here, there are no other replicas to track.
+				a.owners = localOwnership{}
+				return nil
 			}
 
-			for _, secret := range secrets {
-				if err := secret.Valid(); err != nil {
-					return fmt.Errorf("invalid secret: %w", err)
-				}
-			}
-			a.config.Secrets = secrets
-			return nil
+			a.ring = newEndpointRing(
+				logging.LoggerWithComponent(a.base.Logger(), "endpoint-ring"),
+				a.kubeClient,
+				appName,
+				k8s.DeployedNamespace(),
+				k8s.PodName(),
+			)
+			a.owners = a.newOwnership(a.ring)
+			return a.ring.Start(ctx)
 		}),
+		web.WithDependencyBootstrap(a.loadConfig),
 		web.WithDependencyBootstrap(func(ctx context.Context) error {
-			interval, err := time.ParseDuration(a.base.Viper().GetString("refresh_interval"))
+			vip := a.base.Viper()
+			vip.SetDefault("reload.debounce", defaultReloadDebounce.String())
+			vip.SetDefault("reload.min_interval", defaultReloadMinInterval.String())
+
+			debounce, err := time.ParseDuration(vip.GetString("reload.debounce"))
 			if err != nil {
-				return fmt.Errorf("failed to parse refresh interval: %w", err)
-			} else if interval <= 0 {
-				return errors.New("invalid refresh interval")
+				return fmt.Errorf("failed to parse reload debounce: %w", err)
 			}
 
-			a.base.Logger().Info("Interval set", slog.String(loggingKeyInterval, interval.String()))
+			minInterval, err := time.ParseDuration(vip.GetString("reload.min_interval"))
+			if err != nil {
+				return fmt.Errorf("failed to parse reload minimum interval: %w", err)
+			}
 
-			a.config.syncInterval = interval
+			a.reloader = newReloader(
+				logging.LoggerWithComponent(a.base.Logger(), "reload-workloads"),
+				a.kubeClient,
+				debounce,
+				minInterval,
+			)
 			return nil
 		}),
+		web.WithDependencyBootstrap(a.loadClusters(false)),
+		a.healthChecks(),
+		// The config is watched once everything a reload updates has been set up.
+		web.WithConfigWatchers(func() {
+			a.reloadConfig(logging.LoggerWithComponent(a.base.Logger(), "config-reload"))
+		}),
+		a.vaultEventsOption(),
+		web.WithIndefiniteAsyncTask("reload-workloads", func(ctx context.Context) {
+			a.reloader.run(ctx)
+		}),
 		web.WithIndefiniteAsyncTask("watch-secrets", a.watchSecrets(
 			logging.LoggerWithComponent(a.base.Logger(), "watch-secrets"),
 		)),
 		web.WithIndefiniteAsyncTask("sync-secrets", a.syncSecretsTicker(
 			logging.LoggerWithComponent(a.base.Logger(), "sync-secrets"),
 		)),
+		web.WithIndefiniteAsyncTask("api", a.serveAPI(
+			logging.LoggerWithComponent(a.base.Logger(), "api"),
+		)),
 	); err != nil {
 		return fmt.Errorf("failed to start web app: %w", err)
 	}
@@ -94,8 +194,143 @@ func (a *App) Start() error {
 	return nil
 }
 
+// healthChecks serves the health checks of the vaults and remote clusters. The checks are
+// registered together as the health check server can only be started once.
+func (a *App) healthChecks() web.StartOption {
+	return func(base *web.App) error {
+		return web.WithHealthCheck(
+			a.vaultHealthCheck(base.Logger()),
+			a.clusterHealthCheck(base.Logger()),
+		)(base)
+	}
+}
+
+// startInformers starts the shared informers the sync loop reads from and waits for their caches to
+// sync.
+func (a *App) startInformers(ctx context.Context) error {
+	if a.informers == nil {
+		return nil
+	}
+
+	a.informers.Start(ctx.Done())
+	a.sources.start(ctx)
+
+	for informerType, synced := range a.informers.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return fmt.Errorf("failed to sync %s informer cache", informerType)
+		}
+	}
+	return nil
+}
+
+// loadConfig reads and validates the secrets, policies, refresh interval, jitter and dry run mode
+// the sync loop starts with, and stores them as the config in effect.
+func (a *App) loadConfig(_ context.Context) error {
+	vip := a.base.Viper()
+
+	cfg, err := parseConfig(vip)
+	if err != nil {
+		return err
+	}
+
+	interval, err := parseRefreshInterval(vip)
+	if err != nil {
+		return err
+	}
+
+	jitter, err := parseRefreshJitter(vip)
+	if err != nil {
+		return err
+	}
+
+	next := *a.currentConfig()
+	next.Secrets = cfg.secrets
+	next.policies = cfg.policies
+	next.syncInterval = interval
+	next.syncJitter = jitter
+	next.dryRun = vip.GetBool("dry_run")
+	a.config.Store(&next)
+
+	a.base.Logger().Info("Interval set", slog.String(loggingKeyInterval, interval.String()))
+	if next.dryRun {
+		a.base.Logger().Warn("Dry run enabled, no changes will be written to Kubernetes")
+	}
+	return nil
+}
+
+// loadSecrets reads and validates the configured secrets and the policies they are checked against.
+func (a *App) loadSecrets(_ context.Context) error {
+	cfg, err := parseConfig(a.base.Viper())
+	if err != nil {
+		return err
+	}
+
+	next := *a.currentConfig()
+	next.Secrets = cfg.secrets
+	next.policies = cfg.policies
+	a.config.Store(&next)
+	return nil
+}
+
+// parsedConfig is the secrets in the config, with the vaults, clusters and policies they were
+// validated against.
+type parsedConfig struct {
+	secrets  []*Secret
+	vaults   map[string]*vaultConfig
+	clusters map[string]*clusterConfig
+	policies []*policy
+}
+
+// parseConfig reads and validates the secrets, vaults, clusters and policies from the config, with a
+// copy of each secret for every cluster it is synced into.
+func parseConfig(vip *viper.Viper) (*parsedConfig, error) {
+	secrets, errs := decodeSecrets(vip.Get("secrets"))
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("error decoding secrets: %w", errors.Join(errs...))
+	}
+
+	vaults, err := parseVaults(vip)
+	if err != nil {
+		return nil, err
+	}
+
+	policies, err := parsePolicies(vip)
+	if err != nil {
+		return nil, err
+	}
+
+	clusters, err := parseClusters(vip)
+	if err != nil {
+		return nil, err
+	}
+
+	errs = validateSecrets(secrets, clusters)
+	errs = append(errs, validateVaultRefs(secrets, vaults)...)
+	errs = append(errs, validateClusterVaultRefs(clusters, vaults)...)
+	errs = append(errs, validateClusterRefs(secrets, clusters)...)
+	errs = append(errs, validateVaultWriters(secrets, clusters)...)
+	errs = append(errs, validateSecretPolicies(secrets, policies)...)
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid secrets: %w", errors.Join(errs...))
+	}
+
+	return &parsedConfig{
+		secrets:  expandClusters(secrets, clusters),
+		vaults:   vaults,
+		clusters: clusters,
+		policies: policies,
+	}, nil
+}
+
 func (a *App) WaitForEnd() {
-	a.base.WaitForEnd(a.base.Shutdown)
+	a.base.WaitForEnd(a.Shutdown)
+}
+
+func (a *App) Shutdown() {
+	a.base.Shutdown()
+	if a.ring != nil {
+		a.ring.Shutdown()
+	}
 }
 
 func main() {
@@ -103,16 +338,67 @@ func main() {
 		logging.WithAppName(appName),
 	)
 
+	flags := flag.NewFlagSet(appName, flag.ExitOnError)
+	once := flags.Bool("once", false, "Sync every configured secret once and exit (same as the sync command)")
+	kubeconfig := flags.String("kubeconfig", "", "Path to a kubeconfig, to run outside of the cluster")
+	kubeContext := flags.String("context", "", "Kubeconfig context to use, the current context if empty")
+
+	command, args := commandServe, os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	if err := flags.Parse(args); err != nil {
+		l.Error("failed to parse flags", slog.Any(logging.KeyError, err))
+		os.Exit(exitCodeUsage)
+	} else if *once {
+		command = commandSync
+	}
+
 	app, err := NewApp(l)
 	if err != nil {
 		l.Error("failed to create app", slog.Any(logging.KeyError, err))
 		panic("failed to create app")
 	}
-
-	if err := app.Start(); err != nil {
-		l.Error("failed to start app", slog.Any(logging.KeyError, err))
-		panic("failed to start app")
+	app.kubeFlags = kubeOptions{
+		kubeconfig: *kubeconfig,
+		context:    *kubeContext,
 	}
 
-	app.WaitForEnd()
+	switch command {
+	case commandServe:
+		if err := app.Start(); err != nil {
+			l.Error("failed to start app", slog.Any(logging.KeyError, err))
+			panic("failed to start app")
+		}
+
+		app.WaitForEnd()
+	case commandDiff:
+		err := app.Diff(os.Stdout)
+		app.Shutdown()
+		if err != nil {
+			l.Error("failed to diff secrets", slog.Any(logging.KeyError, err))
+			os.Exit(exitCodeFailure)
+		}
+	case commandValidate:
+		ok, err := app.Validate(os.Stdout)
+		app.Shutdown()
+		if err != nil {
+			l.Error("failed to validate config", slog.Any(logging.KeyError, err))
+			os.Exit(exitCodeFailure)
+		} else if !ok {
+			os.Exit(exitCodeFailure)
+		}
+	case commandSync:
+		ok, err := app.SyncOnce(os.Stdout)
+		app.Shutdown()
+		if err != nil {
+			l.Error("failed to sync secrets", slog.Any(logging.KeyError, err))
+			os.Exit(exitCodeFailure)
+		} else if !ok {
+			os.Exit(exitCodeFailure)
+		}
+	default:
+		l.Error("unknown command", slog.String(logging.KeyName, command))
+		os.Exit(exitCodeUsage)
+	}
 }
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var nextSyncTimestamp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "secret_sync_next_sync_timestamp_seconds",
+	Help: "Unix time at which each secret is next due to sync from vault.",
+}, []string{"cluster", "namespace", "name"})
+
+var policyViolations = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "secret_sync_policy_violations_total",
+	Help: "Number of syncs refused because the policies do not allow the secret into its namespace.",
+}, []string{"cluster", "namespace", "name"})
+
+var pinnedVersion = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "secret_sync_pinned_version",
+	Help: "Vault version each pinned secret is held at. Secrets that are not pinned are not reported.",
+}, []string{"cluster", "namespace", "name"})
+
+var pausedSecrets = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "secret_sync_paused",
+	Help: "Set to 1 for each secret whose destination is paused. Secrets that are not paused are not reported.",
+}, []string{"cluster", "namespace", "name"})
+
+// recordNextSync records when the secret is next due to sync.
+func recordNextSync(secret *Secret, next time.Time) {
+	nextSyncTimestamp.WithLabelValues(secret.metricLabels()...).Set(float64(next.Unix()))
+}
+
+// forgetNextSync removes the next sync time of a secret that is no longer scheduled.
+func forgetNextSync(secret *Secret) {
+	nextSyncTimestamp.DeleteLabelValues(secret.metricLabels()...)
+}
+
+// recordPolicyViolation counts a sync of the secret refused by policy.
+func recordPolicyViolation(secret *Secret) {
+	policyViolations.WithLabelValues(secret.metricLabels()...).Inc()
+}
+
+// recordPin records the vault version the secret is pinned to, removing it if the version is 0.
+func recordPin(secret *Secret, version int) {
+	if version == 0 {
+		pinnedVersion.DeleteLabelValues(secret.metricLabels()...)
+		return
+	}
+	pinnedVersion.WithLabelValues(secret.metricLabels()...).Set(float64(version))
+}
+
+// recordPaused records whether the secret's destination is paused.
+func recordPaused(secret *Secret, paused bool) {
+	if !paused {
+		pausedSecrets.DeleteLabelValues(secret.metricLabels()...)
+		return
+	}
+	pausedSecrets.WithLabelValues(secret.metricLabels()...).Set(1)
+}
+
+// metricLabels returns the cluster, namespace and name labels of the secret. Files are labelled
+// with their path as the name.
+func (s *Secret) metricLabels() []string {
+	if s.File != nil {
+		return []string{"", "", s.File.Path}
+	}
+	return []string{s.cluster, s.DestinationNamespace, s.DestinationName}
+}
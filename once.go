@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/jacobbrewer1/web"
+	"github.com/jacobbrewer1/web/cache"
+	"github.com/jacobbrewer1/web/logging"
+)
+
+// Ensures that allBucket implements the HashBucket interface.
+var _ cache.HashBucket = allBucket{}
+
+// allBucket is a hash bucket that owns every key, used when work is not sharded between replicas.
+type allBucket struct{}
+
+func (allBucket) InBucket(string) bool {
+	return true
+}
+
+// SyncOnce syncs every configured secret exactly once, without sharding, and writes a summary to w.
+// It reports false if any secret failed to sync.
+func (a *App) SyncOnce(w io.Writer) (bool, error) {
+	if err := a.base.Start(
+		web.WithMetricsEnabled(false),
+		web.WithViperConfig(),
+		web.WithDependencyBootstrap(a.loadVaults),
+		web.WithDependencyBootstrap(a.loadHasher),
+		a.kubeClientOption(),
+		web.WithDependencyBootstrap(a.startInformers),
+		web.WithDependencyBootstrap(a.loadSecrets),
+		web.WithDependencyBootstrap(a.loadClusters(true)),
+	); err != nil {
+		return false, fmt.Errorf("failed to start web app: %w", err)
+	}
+
+	ctx, cancel := a.base.ChildContext()
+	defer cancel()
+
+	a.newSyncer().syncSecrets(
+		ctx,
+		logging.LoggerWithComponent(a.base.Logger(), "sync-once"),
+		allBucket{},
+		a.currentConfig().Secrets,
+	)
+
+	return writeSyncSummary(w, a.status, a.currentConfig().Secrets), nil
+}
+
+// writeSyncSummary writes the outcome of every secret as a table, reporting false if any failed.
+func writeSyncSummary(w io.Writer, status *statusStore, secrets []*Secret) bool {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CLUSTER\tNAMESPACE\tNAME\tRESULT\tVAULT VERSION\tERROR")
+
+	failed, paused := 0, 0
+	for _, secret := range secrets {
+		st, synced := status.get(secret)
+		result := "synced"
+		switch {
+		case st.Paused:
+			result = "paused"
+			paused++
+		case st.LastError != "":
+			result = "failed"
+			failed++
+		case !synced:
+			result = "failed"
+			st.LastError = "not synced"
+			failed++
+		}
+
+		cluster, namespace, name := clusterDisplayName(st.Cluster), st.Namespace, st.Name
+		if st.Path != "" {
+			cluster, namespace, name = "file", "-", st.Path
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n", cluster, namespace, name, result, st.VaultVersion, st.LastError)
+	}
+	_ = tw.Flush()
+
+	fmt.Fprintf(w, "\n%d synced, %d failed", len(secrets)-failed-paused, failed)
+	if paused > 0 {
+		fmt.Fprintf(w, ", %d paused", paused)
+	}
+	fmt.Fprintln(w)
+	return failed == 0
+}
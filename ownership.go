@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/serialx/hashring"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	kubeCache "k8s.io/client-go/tools/cache"
+)
+
+// endpointRing is the consistent hash ring of the replicas backing the application's EndpointSlice.
+// It is the hash bucket deciding which secrets this replica syncs, and resolves the owning replica
+// of any key, and the address it can be reached on, from the same ring.
+type endpointRing struct {
+	mut *sync.RWMutex
+
+	// hr is the consistent hash ring of pod names.
+	hr *hashring.HashRing
+
+	// addresses maps pod names to their endpoint address.
+	addresses map[string]string
+
+	l            *slog.Logger
+	appName      string
+	appNamespace string
+	thisPod      string
+
+	informerFactory   informers.SharedInformerFactory
+	endpointsInformer kubeCache.SharedIndexInformer
+
+	// changes is signalled when the pods in the ring change.
+	changes chan struct{}
+}
+
+func newEndpointRing(
+	l *slog.Logger,
+	kubeClient kubernetes.Interface,
+	appName, appNamespace, thisPod string,
+) *endpointRing {
+	informerFactory := informers.NewSharedInformerFactoryWithOptions(
+		kubeClient,
+		10*time.Second,
+		informers.WithNamespace(appNamespace),
+	)
+	return &endpointRing{
+		mut:               new(sync.RWMutex),
+		hr:                hashring.New(make([]string, 0)),
+		addresses:         make(map[string]string),
+		l:                 l,
+		appName:           appName,
+		appNamespace:      appNamespace,
+		thisPod:           thisPod,
+		informerFactory:   informerFactory,
+		endpointsInformer: informerFactory.Discovery().V1().EndpointSlices().Informer(),
+		changes:           make(chan struct{}, 1),
+	}
+}
+
+// Start starts watching the application's endpoints and blocks until the initial ring is built.
+func (r *endpointRing) Start(ctx context.Context) error {
+	if ctx == nil {
+		return errors.New("context cannot be nil")
+	}
+
+	onChange := func(any) { r.rebuild() }
+	if _, err := r.endpointsInformer.AddEventHandler(kubeCache.ResourceEventHandlerFuncs{
+		AddFunc:    onChange,
+		UpdateFunc: func(_, newObj any) { onChange(newObj) },
+		DeleteFunc: onChange,
+	}); err != nil {
+		return fmt.Errorf("error adding event handler to endpoints informer: %w", err)
+	}
+
+	r.informerFactory.Start(ctx.Done())
+	r.informerFactory.WaitForCacheSync(ctx.Done())
+	r.rebuild()
+	return nil
+}
+
+// Shutdown stops the endpoints informer.
+func (r *endpointRing) Shutdown() {
+	r.informerFactory.Shutdown()
+}
+
+// Changes returns a channel that is signalled when pods join or leave the ring.
+func (r *endpointRing) Changes() <-chan struct{} {
+	return r.changes
+}
+
+// Owner returns the name of the pod that owns the given key and the address it can be reached on.
+func (r *endpointRing) Owner(key string) (pod, address string) {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+
+	pod, _ = r.hr.GetNode(key)
+	return pod, r.addresses[pod]
+}
+
+// InBucket reports whether the given key is owned by this replica.
+func (r *endpointRing) InBucket(key string) bool {
+	pod, _ := r.Owner(key)
+	return r.IsLocal(pod)
+}
+
+// Address returns the endpoint address of the given pod.
+func (r *endpointRing) Address(pod string) string {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+
+	return r.addresses[pod]
+}
+
+// IsLocal reports whether the given pod is this replica.
+func (r *endpointRing) IsLocal(pod string) bool {
+	return pod == r.thisPod
+}
+
+// rebuild recreates the ring from the cached EndpointSlice.
+func (r *endpointRing) rebuild() {
+	slices, err := r.informerFactory.Discovery().V1().EndpointSlices().Lister().
+		EndpointSlices(r.appNamespace).
+		List(labels.Everything())
+	if err != nil {
+		r.l.Error("Error listing endpoint slices", slog.String(loggingKeyError, err.Error()))
+		return
+	}
+
+	addresses := make(map[string]string)
+	for _, slice := range slices {
+		// The hash bucket only considers the slice named after the application.
+		if slice.Name != r.appName {
+			continue
+		}
+		for pod, addr := range endpointAddresses(slice) {
+			addresses[pod] = addr
+		}
+	}
+
+	nodes := make([]string, 0, len(addresses))
+	for pod := range addresses {
+		nodes = append(nodes, pod)
+	}
+
+	r.mut.Lock()
+	changed := len(addresses) != len(r.addresses)
+	for pod := range addresses {
+		if _, ok := r.addresses[pod]; !ok {
+			changed = true
+		}
+	}
+	r.hr = hashring.New(nodes)
+	r.addresses = addresses
+	r.mut.Unlock()
+
+	if !changed {
+		return
+	}
+
+	select {
+	case r.changes <- struct{}{}:
+	default:
+		// A change is already pending, the receiver reads the latest ring.
+	}
+}
+
+// endpointAddresses maps the pods backing an EndpointSlice to their first address.
+func endpointAddresses(slice *discoveryv1.EndpointSlice) map[string]string {
+	addresses := make(map[string]string)
+	for _, endpoint := range slice.Endpoints {
+		if endpoint.TargetRef == nil || endpoint.TargetRef.Kind != "Pod" {
+			continue
+		}
+
+		addr := ""
+		if len(endpoint.Addresses) > 0 {
+			addr = endpoint.Addresses[0]
+		}
+		addresses[endpoint.TargetRef.Name] = addr
+	}
+	return addresses
+}
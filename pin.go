@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	hashiVault "github.com/hashicorp/vault/api"
+	"github.com/jacobbrewer1/vaulty"
+	coreErr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var (
+	ErrInvalidPin               = errors.New("invalid pin-version annotation")
+	ErrPinnedVersionUnavailable = errors.New("pinned version is deleted or destroyed")
+	ErrPinNotSupported          = errors.New("only secrets synced from vault into kubernetes can be pinned")
+	ErrPinDryRun                = errors.New("pins cannot be changed in dry run")
+)
+
+// pinnedVersion returns the vault version the secret is pinned to by the annotation on its
+// destination, or 0 if it is not pinned.
+func (s *syncer) pinnedVersion(secret *Secret) (int, error) {
+	if secret.File != nil || secret.reverse() {
+		return 0, nil
+	}
+
+	existing, err := s.secretLister.Secrets(secret.DestinationNamespace).Get(secret.DestinationName)
+	if coreErr.IsNotFound(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("error getting existing secret: %w", err)
+	} else if !managedSelector.Matches(labels.Set(existing.Labels)) {
+		return 0, nil
+	}
+
+	value, ok := existing.Annotations[secretAnnotationPinVersion]
+	if !ok {
+		return 0, nil
+	}
+
+	version, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || version <= 0 {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidPin, value)
+	}
+	return version, nil
+}
+
+// readVersion reads the given version of the secret from vault. A deleted or destroyed version is
+// reported as unavailable rather than as the source being deleted, so that on_source_deleted is not
+// applied to a pinned secret.
+func (s *syncer) readVersion(ctx context.Context, secret *Secret, version int) (*hashiVault.KVSecret, error) {
+	vaultClient, err := s.vaults.forSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	vaultSecret, err := vaultClient.Path(
+		secret.Name,
+		vaulty.WithMount(secret.Mount),
+		vaulty.WithVersion(uint(version)), // nolint:gosec // Pins are positive
+	).GetKvSecretV2(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting version %d: %w", version, err)
+	} else if vaultSecret.Data == nil {
+		return nil, fmt.Errorf("%w: version %d", ErrPinnedVersionUnavailable, version)
+	}
+	return vaultSecret, nil
+}
+
+// setPin pins the secret to the given vault version by annotating its destination, or removes the
+// pin if the version is 0.
+func (s *syncer) setPin(ctx context.Context, secret *Secret, version int) error {
+	if s.plan != nil {
+		return ErrPinDryRun
+	}
+
+	existing, err := s.secretLister.Secrets(secret.DestinationNamespace).Get(secret.DestinationName)
+	if err != nil {
+		return fmt.Errorf("error getting existing secret: %w", err)
+	} else if !secret.syncedFrom(existing) {
+		return fmt.Errorf("secret %s/%s is not managed by %s", secret.DestinationNamespace, secret.DestinationName, appName)
+	}
+
+	var value any
+	if version > 0 {
+		value = strconv.Itoa(version)
+	}
+
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]any{
+				secretAnnotationPinVersion: value,
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error marshalling patch: %w", err)
+	}
+
+	if _, err := s.kubeClient.CoreV1().Secrets(secret.DestinationNamespace).Patch(ctx, secret.DestinationName, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("error patching secret: %w", err)
+	}
+	return nil
+}
+
+// logPin logs when the secret is pinned, moved to another pinned version or unpinned.
+func (s *syncer) logPin(l *slog.Logger, secret *Secret, version int) {
+	if !s.status.pin(secret, version) {
+		return
+	}
+
+	if version > 0 {
+		l.Warn("Secret pinned to vault version", slog.Int(loggingKeyVersion, version))
+	} else {
+		l.Info("Secret pin removed, syncing the latest version")
+	}
+}
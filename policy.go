@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"slices"
+
+	"github.com/spf13/viper"
+	coreErr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// policyEffectAllow restricts the matched paths to the matched namespaces.
+	policyEffectAllow = "allow"
+
+	// policyEffectDeny refuses to deliver the matched paths to the matched namespaces.
+	policyEffectDeny = "deny"
+
+	// eventReasonPolicyViolation is the reason of the event emitted when a sync is refused by policy.
+	eventReasonPolicyViolation = "PolicyViolation"
+)
+
+var (
+	ErrPolicyViolation      = errors.New("policy violation")
+	ErrInvalidPolicy        = errors.New("invalid policy")
+	ErrUnknownPolicyEffect  = errors.New("unknown policy effect")
+	ErrInvalidPolicyPattern = errors.New("invalid policy pattern")
+)
+
+// policy is a rule from the policies config deciding which vault paths may be delivered to which
+// namespaces.
+type policy struct {
+	Name string `mapstructure:"name"`
+
+	// Effect is allow or deny.
+	Effect string `mapstructure:"effect"`
+
+	// Paths are globs matched against the secret's mount/name.
+	Paths []string `mapstructure:"paths"`
+
+	// Namespaces are globs matched against the destination namespace. The rule matches every
+	// namespace if neither Namespaces nor NamespaceSelector is set.
+	Namespaces []string `mapstructure:"namespaces"`
+
+	// NamespaceSelector is a label selector matched against the destination namespace's labels.
+	NamespaceSelector string `mapstructure:"namespace_selector"`
+
+	selector labels.Selector
+}
+
+// Valid returns every problem with the policy, and parses its namespace selector.
+func (p *policy) Valid() error {
+	errs := make([]error, 0)
+	if p.Name == "" {
+		errs = append(errs, fmt.Errorf("%w: name is required", ErrInvalidPolicy))
+	}
+
+	switch p.Effect {
+	case policyEffectAllow, policyEffectDeny:
+	default:
+		errs = append(errs, fmt.Errorf("%w: %q", ErrUnknownPolicyEffect, p.Effect))
+	}
+
+	if len(p.Paths) == 0 {
+		errs = append(errs, fmt.Errorf("%w: paths are required", ErrInvalidPolicy))
+	}
+
+	for _, pattern := range slices.Concat(p.Paths, p.Namespaces) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("%w: %q", ErrInvalidPolicyPattern, pattern))
+		}
+	}
+
+	if p.NamespaceSelector != "" {
+		selector, err := labels.Parse(p.NamespaceSelector)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%w: namespace_selector: %w", ErrInvalidPolicy, err))
+		} else {
+			p.selector = selector
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// matchesPath reports whether the policy applies to the given vault mount/name.
+func (p *policy) matchesPath(source string) bool {
+	for _, pattern := range p.Paths {
+		if ok, _ := path.Match(pattern, source); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesNamespace reports whether the policy applies to the given namespace. Without the namespace's
+// labels a rule that only matches by selector cannot be decided, and known is false.
+func (p *policy) matchesNamespace(namespace string, namespaceLabels labels.Set) (matched, known bool) {
+	if len(p.Namespaces) == 0 && p.selector == nil {
+		return true, true
+	}
+
+	for _, pattern := range p.Namespaces {
+		if ok, _ := path.Match(pattern, namespace); ok {
+			return true, true
+		}
+	}
+
+	switch {
+	case p.selector == nil:
+		return false, true
+	case namespaceLabels == nil:
+		return false, false
+	default:
+		return p.selector.Matches(namespaceLabels), true
+	}
+}
+
+// checkPolicies returns ErrPolicyViolation if the policies refuse to deliver the secret into its
+// destination namespace. A deny rule matching the path and namespace refuses the secret. If any
+// allow rule matches the path, one of them must also match the namespace. With nil namespace
+// labels, rules that cannot be decided without them do not refuse the secret.
+func checkPolicies(policies []*policy, secret *Secret, namespaceLabels labels.Set) error {
+	source := secret.source()
+	allowRules := make([]string, 0)
+	allowed := false
+	for _, p := range policies {
+		if !p.matchesPath(source) {
+			continue
+		}
+
+		matched, known := p.matchesNamespace(secret.DestinationNamespace, namespaceLabels)
+		switch p.Effect {
+		case policyEffectDeny:
+			if matched {
+				return fmt.Errorf("%w: %s is denied in namespace %s by policy %q", ErrPolicyViolation, source, secret.DestinationNamespace, p.Name)
+			}
+		case policyEffectAllow:
+			allowRules = append(allowRules, p.Name)
+			allowed = allowed || matched || !known
+		}
+	}
+
+	if len(allowRules) > 0 && !allowed {
+		return fmt.Errorf("%w: %s is not allowed in namespace %s by policies %q", ErrPolicyViolation, source, secret.DestinationNamespace, allowRules)
+	}
+	return nil
+}
+
+// checkPolicies refuses to sync the secret if the policies do not allow it into its destination
+// namespace. A refusal is counted, and reported with an event when it is first seen.
+func (s *syncer) checkPolicies(ctx context.Context, l *slog.Logger, secret *Secret) error {
+	if len(s.policies) == 0 {
+		return nil
+	}
+
+	namespaceLabels := make(labels.Set)
+	namespace, err := s.namespaceLister.Get(secret.DestinationNamespace)
+	switch {
+	case coreErr.IsNotFound(err):
+	case err != nil:
+		return fmt.Errorf("error getting namespace: %w", err)
+	case namespace.Labels != nil:
+		namespaceLabels = namespace.Labels
+	}
+
+	err = checkPolicies(s.policies, secret, namespaceLabels)
+	if err == nil {
+		return nil
+	}
+
+	recordPolicyViolation(secret)
+	if st, _ := s.status.get(secret); st.PolicyViolation || s.plan != nil {
+		return err
+	}
+
+	l.Warn("Sync refused by policy", slog.String(loggingKeyError, err.Error()))
+	if eventErr := emitWarning(ctx, s.kubeClient, secret, eventReasonPolicyViolation, err.Error()); eventErr != nil {
+		l.Error("Error emitting event", slog.String(loggingKeyError, eventErr.Error()))
+	}
+	return err
+}
+
+// parsePolicies reads and validates the policies from the config.
+func parsePolicies(vip *viper.Viper) ([]*policy, error) {
+	policies, err := decodePolicies(vip)
+	if err != nil {
+		return nil, err
+	}
+
+	if errs := validatePolicies(policies); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid policies: %w", errors.Join(errs...))
+	}
+	return policies, nil
+}
+
+// decodePolicies strictly decodes the policies from the config, rejecting unknown fields.
+func decodePolicies(vip *viper.Viper) ([]*policy, error) {
+	policies := make([]*policy, 0)
+	if errs := decodeStrict(vip.Get("policies"), &policies); len(errs) > 0 {
+		return nil, fmt.Errorf("error decoding policies: %w", errors.Join(errs...))
+	}
+	return policies, nil
+}
+
+// validatePolicies returns every problem with the policies.
+func validatePolicies(policies []*policy) []error {
+	errs := make([]error, 0)
+	for i, p := range policies {
+		if err := p.Valid(); err != nil {
+			for _, e := range unjoin(err) {
+				errs = append(errs, fmt.Errorf("policies[%d]: %w", i, e))
+			}
+		}
+	}
+	return errs
+}
+
+// validateSecretPolicies returns an error for every secret the policies refuse. Rules that select
+// namespaces by label are checked when the secret is synced.
+func validateSecretPolicies(secrets []*Secret, policies []*policy) []error {
+	errs := make([]error, 0)
+	for i, secret := range secrets {
+		if secret == nil || secret.File != nil {
+			// Files are not written into a namespace.
+			continue
+		} else if err := checkPolicies(policies, secret, nil); err != nil {
+			errs = append(errs, fmt.Errorf("secrets[%d]: %w", i, err))
+		}
+	}
+	return errs
+}
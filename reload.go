@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	kubeErr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	// defaultReloadDebounce is how long to wait after a secret changes before restarting the
+	// workloads that use it, so that several secrets rotating together cause a single restart.
+	defaultReloadDebounce = 10 * time.Second
+
+	// defaultReloadMinInterval is the minimum time between two restarts of the same workload.
+	defaultReloadMinInterval = time.Minute
+)
+
+type workloadKind string
+
+const (
+	workloadKindDeployment  workloadKind = "Deployment"
+	workloadKindStatefulSet workloadKind = "StatefulSet"
+	workloadKindDaemonSet   workloadKind = "DaemonSet"
+)
+
+// workloadRef identifies a workload that has opted in to restarts.
+type workloadRef struct {
+	kind      workloadKind
+	namespace string
+	name      string
+}
+
+func (w workloadRef) String() string {
+	return fmt.Sprintf("%s %s/%s", w.kind, w.namespace, w.name)
+}
+
+// workload is the part of a Deployment, StatefulSet or DaemonSet the reloader needs.
+type workload struct {
+	ref                 workloadRef
+	annotations         map[string]string
+	templateAnnotations map[string]string
+}
+
+// reloader triggers rolling restarts of workloads that opt in with the reload annotation when a
+// secret they reference changes. Restarts are debounced and rate limited per workload, and failed
+// restarts are retried with backoff.
+type reloader struct {
+	l           *slog.Logger
+	kubeClient  kubernetes.Interface
+	queue       workqueue.TypedRateLimitingInterface[workloadRef]
+	debounce    time.Duration
+	minInterval time.Duration
+
+	mut         *sync.Mutex
+	lastRestart map[workloadRef]time.Time
+
+	// lastChange holds when a secret each workload references last changed. A workload is restarted
+	// once its secrets have not changed for the debounce.
+	lastChange map[workloadRef]time.Time
+}
+
+func newReloader(
+	l *slog.Logger,
+	kubeClient kubernetes.Interface,
+	debounce, minInterval time.Duration,
+) *reloader {
+	return &reloader{
+		l:          l,
+		kubeClient: kubeClient,
+		queue: workqueue.NewTypedRateLimitingQueueWithConfig(
+			workqueue.DefaultTypedControllerRateLimiter[workloadRef](),
+			workqueue.TypedRateLimitingQueueConfig[workloadRef]{Name: "reload-workloads"},
+		),
+		debounce:    debounce,
+		minInterval: minInterval,
+		mut:         new(sync.Mutex),
+		lastRestart: make(map[workloadRef]time.Time),
+		lastChange:  make(map[workloadRef]time.Time),
+	}
+}
+
+// Notify schedules a restart of every workload in the namespace that references the secret.
+func (r *reloader) Notify(ctx context.Context, namespace, secretName string) {
+	if r == nil {
+		return
+	}
+
+	workloads, err := listWorkloads(ctx, r.kubeClient, namespace)
+	if err != nil {
+		r.l.Error("Error listing workloads",
+			slog.String(loggingKeyNamespace, namespace),
+			slog.String(loggingKeyError, err.Error()),
+		)
+		return
+	}
+
+	for _, w := range workloads {
+		if !references(w.annotations[workloadAnnotationReload], secretName) {
+			continue
+		}
+
+		r.l.Debug("Scheduling workload restart",
+			slog.String(loggingKeyWorkload, w.ref.String()),
+			slog.String(loggingKeyDestination, secretName),
+		)
+		r.mut.Lock()
+		r.lastChange[w.ref] = time.Now()
+		r.mut.Unlock()
+		r.queue.AddAfter(w.ref, r.debounce)
+	}
+}
+
+// run processes scheduled restarts until the context is cancelled.
+func (r *reloader) run(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		r.queue.ShutDown()
+	}()
+
+	for {
+		ref, shutdown := r.queue.Get()
+		if shutdown {
+			r.l.Info("Stopping workload reloader")
+			return
+		}
+
+		r.process(ctx, ref)
+		r.queue.Done(ref)
+	}
+}
+
+func (r *reloader) process(ctx context.Context, ref workloadRef) {
+	l := r.l.With(slog.String(loggingKeyWorkload, ref.String()))
+
+	r.mut.Lock()
+	changed := r.lastChange[ref]
+	settle := r.debounce - time.Since(changed)
+	wait := r.minInterval - time.Since(r.lastRestart[ref])
+	r.mut.Unlock()
+	if settle > 0 {
+		// A secret changed again since the restart was scheduled, wait until they settle.
+		r.queue.AddAfter(ref, settle)
+		return
+	} else if wait > 0 {
+		l.Debug("Workload restarted recently, delaying restart", slog.String(loggingKeyInterval, wait.String()))
+		r.queue.AddAfter(ref, wait)
+		return
+	}
+
+	if err := r.restart(ctx, l, ref); err != nil {
+		l.Error("Error restarting workload, retrying", slog.String(loggingKeyError, err.Error()))
+		r.queue.AddRateLimited(ref)
+		return
+	}
+
+	r.queue.Forget(ref)
+	r.mut.Lock()
+	if r.lastChange[ref].Equal(changed) {
+		delete(r.lastChange, ref)
+	}
+	r.mut.Unlock()
+}
+
+// restart restarts the workload if the secrets it references have changed since its last restart.
+func (r *reloader) restart(ctx context.Context, l *slog.Logger, ref workloadRef) error {
+	w, err := getWorkload(ctx, r.kubeClient, ref)
+	if kubeErr.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error getting workload: %w", err)
+	}
+
+	checksum, err := r.checksum(ctx, ref.namespace, w.annotations[workloadAnnotationReload])
+	if err != nil {
+		return fmt.Errorf("error calculating secret checksum: %w", err)
+	} else if w.templateAnnotations[podTemplateAnnotationChecksum] == checksum {
+		return nil
+	}
+
+	if err := patchWorkloadTemplate(ctx, r.kubeClient, ref, checksum); err != nil {
+		return err
+	}
+
+	r.mut.Lock()
+	r.lastRestart[ref] = time.Now()
+	r.mut.Unlock()
+
+	l.Info("Workload restarted after secret change")
+	return nil
+}
+
+// checksum combines the sync hashes of the referenced secrets, so that workloads are only
+// restarted when the content they consume has changed.
+func (r *reloader) checksum(ctx context.Context, namespace, reloadAnnotation string) (string, error) {
+	names := reloadSecretNames(reloadAnnotation)
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		secret, err := r.kubeClient.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if kubeErr.IsNotFound(err) {
+			parts = append(parts, name+"=")
+			continue
+		} else if err != nil {
+			return "", fmt.Errorf("error getting secret %s: %w", name, err)
+		}
+		parts = append(parts, name+"="+secret.Annotations[secretAnnotationSyncIdKey])
+	}
+
+	return shaHash([]byte(strings.Join(parts, ","))), nil
+}
+
+// reloadSecretNames parses the comma separated secret names of a reload annotation.
+func reloadSecretNames(annotation string) []string {
+	names := make([]string, 0)
+	for _, name := range strings.Split(annotation, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func references(annotation, secretName string) bool {
+	for _, name := range reloadSecretNames(annotation) {
+		if name == secretName {
+			return true
+		}
+	}
+	return false
+}
+
+// listWorkloads returns every Deployment, StatefulSet and DaemonSet in the namespace.
+func listWorkloads(ctx context.Context, kubeClient kubernetes.Interface, namespace string) ([]*workload, error) {
+	apps := kubeClient.AppsV1()
+	workloads := make([]*workload, 0)
+
+	deployments, err := apps.Deployments(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing deployments: %w", err)
+	}
+	for i := range deployments.Items {
+		d := &deployments.Items[i]
+		workloads = append(workloads, &workload{
+			ref:                 workloadRef{kind: workloadKindDeployment, namespace: d.Namespace, name: d.Name},
+			annotations:         d.Annotations,
+			templateAnnotations: d.Spec.Template.Annotations,
+		})
+	}
+
+	statefulSets, err := apps.StatefulSets(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing statefulsets: %w", err)
+	}
+	for i := range statefulSets.Items {
+		s := &statefulSets.Items[i]
+		workloads = append(workloads, &workload{
+			ref:                 workloadRef{kind: workloadKindStatefulSet, namespace: s.Namespace, name: s.Name},
+			annotations:         s.Annotations,
+			templateAnnotations: s.Spec.Template.Annotations,
+		})
+	}
+
+	daemonSets, err := apps.DaemonSets(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing daemonsets: %w", err)
+	}
+	for i := range daemonSets.Items {
+		d := &daemonSets.Items[i]
+		workloads = append(workloads, &workload{
+			ref:                 workloadRef{kind: workloadKindDaemonSet, namespace: d.Namespace, name: d.Name},
+			annotations:         d.Annotations,
+			templateAnnotations: d.Spec.Template.Annotations,
+		})
+	}
+
+	return workloads, nil
+}
+
+func getWorkload(ctx context.Context, kubeClient kubernetes.Interface, ref workloadRef) (*workload, error) {
+	apps := kubeClient.AppsV1()
+	w := &workload{
+		ref: ref,
+	}
+
+	switch ref.kind {
+	case workloadKindDeployment:
+		d, err := apps.Deployments(ref.namespace).Get(ctx, ref.name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		w.annotations, w.templateAnnotations = d.Annotations, d.Spec.Template.Annotations
+	case workloadKindStatefulSet:
+		s, err := apps.StatefulSets(ref.namespace).Get(ctx, ref.name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		w.annotations, w.templateAnnotations = s.Annotations, s.Spec.Template.Annotations
+	case workloadKindDaemonSet:
+		d, err := apps.DaemonSets(ref.namespace).Get(ctx, ref.name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		w.annotations, w.templateAnnotations = d.Annotations, d.Spec.Template.Annotations
+	default:
+		return nil, fmt.Errorf("unknown workload kind %s", ref.kind)
+	}
+
+	return w, nil
+}
+
+// patchWorkloadTemplate sets the checksum annotation on the pod template, which rolls the workload.
+func patchWorkloadTemplate(ctx context.Context, kubeClient kubernetes.Interface, ref workloadRef, checksum string) error {
+	patch, err := json.Marshal(map[string]any{
+		"spec": map[string]any{
+			"template": map[string]any{
+				"metadata": map[string]any{
+					"annotations": map[string]string{
+						podTemplateAnnotationChecksum: checksum,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error marshalling patch: %w", err)
+	}
+
+	apps := kubeClient.AppsV1()
+	switch ref.kind {
+	case workloadKindDeployment:
+		_, err = apps.Deployments(ref.namespace).Patch(ctx, ref.name, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+	case workloadKindStatefulSet:
+		_, err = apps.StatefulSets(ref.namespace).Patch(ctx, ref.name, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+	case workloadKindDaemonSet:
+		_, err = apps.DaemonSets(ref.namespace).Patch(ctx, ref.name, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+	default:
+		return fmt.Errorf("unknown workload kind %s", ref.kind)
+	}
+	if err != nil {
+		return fmt.Errorf("error patching %s: %w", ref, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newReloadClient returns a clientset with a Deployment that reloads on changes to the app secret.
+func newReloadClient() *fake.Clientset {
+	return fake.NewClientset(
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "app",
+				Namespace:   "default",
+				Annotations: map[string]string{workloadAnnotationReload: "app"},
+			},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "app",
+				Namespace:   "default",
+				Annotations: map[string]string{secretAnnotationSyncIdKey: "sync-1"},
+			},
+		},
+	)
+}
+
+// restartedAt returns the checksum annotation of the Deployment's pod template.
+func restartedAt(tb testing.TB, kubeClient *fake.Clientset) string {
+	tb.Helper()
+
+	d, err := kubeClient.AppsV1().Deployments("default").Get(context.Background(), "app", metav1.GetOptions{})
+	if err != nil {
+		tb.Fatalf("getting deployment: %v", err)
+	}
+	return d.Spec.Template.Annotations[podTemplateAnnotationChecksum]
+}
+
+// waitRestarted waits for the Deployment to be restarted.
+func waitRestarted(tb testing.TB, kubeClient *fake.Clientset, timeout time.Duration) {
+	tb.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for restartedAt(tb, kubeClient) == "" {
+		if time.Now().After(deadline) {
+			tb.Fatal("deployment was not restarted")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestReloaderTrailingDebounce(t *testing.T) {
+	ctx := t.Context()
+	kubeClient := newReloadClient()
+
+	r := newReloader(slog.New(slog.DiscardHandler), kubeClient, 500*time.Millisecond, 0)
+	go r.run(ctx)
+
+	r.Notify(ctx, "default", "app")
+	time.Sleep(300 * time.Millisecond)
+	r.Notify(ctx, "default", "app")
+
+	// The first change's debounce has passed, but the second change restarts it.
+	time.Sleep(300 * time.Millisecond)
+	if got := restartedAt(t, kubeClient); got != "" {
+		t.Fatal("deployment restarted before the secrets settled")
+	}
+
+	waitRestarted(t, kubeClient, 5*time.Second)
+}
+
+func TestReloaderRetriesFailedRestart(t *testing.T) {
+	ctx := t.Context()
+	kubeClient := newReloadClient()
+
+	var patches atomic.Int32
+	kubeClient.PrependReactor("patch", "deployments", func(k8stesting.Action) (bool, runtime.Object, error) {
+		if patches.Add(1) == 1 {
+			return true, nil, errors.New("apiserver unavailable")
+		}
+		return false, nil, nil
+	})
+
+	r := newReloader(slog.New(slog.DiscardHandler), kubeClient, 0, 0)
+	go r.run(ctx)
+
+	r.Notify(ctx, "default", "app")
+	waitRestarted(t, kubeClient, 5*time.Second)
+
+	if got := patches.Load(); got != 2 {
+		t.Errorf("deployment patched %d times, want 2", got)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"unicode/utf8"
+
+	hashiVault "github.com/hashicorp/vault/api"
+	"github.com/jacobbrewer1/web/cache"
+	corev1 "k8s.io/api/core/v1"
+	coreErr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// directionVaultToK8s syncs the vault secret into the Kubernetes Secret.
+	directionVaultToK8s = "vault-to-k8s"
+
+	// directionK8sToVault pushes the Kubernetes Secret into the vault secret.
+	directionK8sToVault = "k8s-to-vault"
+
+	// vaultMetadataManagedBy and vaultMetadataSource are the custom metadata marking a vault secret
+	// as written by secret-sync from a Kubernetes Secret. Only that Kubernetes Secret is pushed into
+	// it, so that two sources cannot overwrite each other in turn.
+	vaultMetadataManagedBy = "managed-by"
+	vaultMetadataSource    = "secret-sync-source"
+
+	// vaultMetadataHash is the custom metadata recording the content hash of the last push, so that
+	// a new version is only written when the Kubernetes Secret changes.
+	vaultMetadataHash = "secret-sync-hash"
+)
+
+var (
+	ErrUnknownDirection      = errors.New("unknown direction")
+	ErrReverseOption         = errors.New("not supported with direction k8s-to-vault")
+	ErrReverseSourceMissing  = errors.New("source secret not found")
+	ErrReverseSourceManaged  = errors.New("source secret is synced from vault")
+	ErrVaultSecretNotOwned   = errors.New("vault secret is not owned by this secret")
+	ErrDuplicateVaultWriter  = errors.New("vault secret is written by more than one secret")
+	ErrReverseInvalidContent = errors.New("source secret cannot be written to vault")
+)
+
+// pushToVault writes the Kubernetes Secret into a new version of the vault secret, or plans the
+// write when running dry. The vault secret is claimed with custom metadata when it is created, and a
+// vault secret claimed by another source, or not written by secret-sync, is never overwritten.
+func (s *syncer) pushToVault(ctx context.Context, l *slog.Logger, secret *Secret) (*syncResult, error) {
+	if err := s.checkPolicies(ctx, l, secret); err != nil {
+		return nil, err
+	}
+
+	source, err := s.sources.get(ctx, secret.DestinationNamespace, secret.DestinationName)
+	if coreErr.IsNotFound(err) {
+		return nil, fmt.Errorf("%w: %s", ErrReverseSourceMissing, secretKey(secret.DestinationNamespace, secret.DestinationName))
+	} else if err != nil {
+		return nil, fmt.Errorf("error getting source secret: %w", err)
+	} else if managedSelector.Matches(labels.Set(source.Labels)) {
+		return nil, fmt.Errorf("%w: %s", ErrReverseSourceManaged, secretKey(source.Namespace, source.Name))
+	}
+
+	data, content, err := vaultData(source)
+	if err != nil {
+		return nil, err
+	}
+	hash := s.hasher.sum(content)
+
+	vaultClient, err := s.vaults.forSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+	kv := vaultClient.Client().KVv2(secret.Mount)
+
+	metadata, err := kv.GetMetadata(ctx, secret.Name)
+	exists := true
+	switch {
+	case errors.Is(err, hashiVault.ErrSecretNotFound):
+		exists = false
+	case err != nil:
+		return nil, fmt.Errorf("error getting secret metadata: %w", err)
+	case !secret.ownsVaultSecret(metadata):
+		return nil, fmt.Errorf("%w: %s", ErrVaultSecretNotOwned, secret.source())
+	}
+
+	if exists {
+		stored, _ := metadata.CustomMetadata[vaultMetadataHash].(string)
+		if s.hasher.matches(stored, content) {
+			if s.plan != nil {
+				s.plan.add(secret.pushChange(changeActionUnchanged, hash))
+			}
+			return &syncResult{vaultVersion: metadata.CurrentVersion, hash: stored}, nil
+		}
+	}
+
+	if s.plan != nil {
+		change := secret.pushChange(changeActionCreate, hash)
+		current := make(map[string][]byte)
+		if exists {
+			change.Action = changeActionUpdate
+			if vaultSecret, err := kv.Get(ctx, secret.Name); err == nil {
+				for k, v := range vaultSecret.Data {
+					current[k] = []byte(fmt.Sprintf("%v", v))
+				}
+			}
+		}
+		change.Added, change.Removed, change.Changed = diffKeys(current, source.Data)
+		s.plan.add(change)
+		return &syncResult{hash: hash}, nil
+	}
+
+	version := 0
+	if exists {
+		version = metadata.CurrentVersion
+	} else if err := kv.PutMetadata(ctx, secret.Name, hashiVault.KVMetadataPutInput{
+		// Claim the path before writing to it, so that it stays owned if the write fails.
+		CustomMetadata: secret.vaultMetadata(""),
+	}); err != nil {
+		return nil, fmt.Errorf("error claiming vault secret: %w", err)
+	}
+
+	// Check-and-set fails if the vault secret was written since its metadata was read.
+	written, err := kv.Put(ctx, secret.Name, data, hashiVault.WithCheckAndSet(version))
+	if err != nil {
+		return nil, fmt.Errorf("error writing secret to vault: %w", err)
+	}
+
+	if err := kv.PatchMetadata(ctx, secret.Name, hashiVault.KVMetadataPatchInput{
+		CustomMetadata: secret.vaultMetadata(hash),
+	}); err != nil {
+		return nil, fmt.Errorf("error recording hash in vault: %w", err)
+	}
+
+	l.Info("Secret pushed to vault", slog.Int(loggingKeyVersion, vaultVersion(written)))
+	return &syncResult{
+		vaultVersion: vaultVersion(written),
+		hash:         hash,
+	}, nil
+}
+
+// vaultData returns the vault secret data for the Kubernetes Secret, and the content its hash is
+// computed from. Vault stores strings, so every value must be valid UTF-8.
+func vaultData(source *corev1.Secret) (map[string]any, []byte, error) {
+	values := make(map[string]string, len(source.Data))
+	for k, v := range source.Data {
+		if !utf8.Valid(v) {
+			return nil, nil, fmt.Errorf("%w: key %q is not valid UTF-8", ErrReverseInvalidContent, k)
+		}
+		values[k] = string(v)
+	}
+	if len(values) == 0 {
+		return nil, nil, fmt.Errorf("%w: no data found in secret", ErrReverseInvalidContent)
+	}
+
+	content, err := json.Marshal(values)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error marshalling secret data: %w", err)
+	}
+
+	data := make(map[string]any, len(values))
+	for k, v := range values {
+		data[k] = v
+	}
+	return data, content, nil
+}
+
+// vaultMetadata returns the custom metadata claiming the vault secret for this secret, with the
+// given content hash if it is not empty.
+func (s *Secret) vaultMetadata(hash string) map[string]any {
+	metadata := map[string]any{
+		vaultMetadataManagedBy: appName,
+		vaultMetadataSource:    s.shardKey(),
+	}
+	if hash != "" {
+		metadata[vaultMetadataHash] = hash
+	}
+	return metadata
+}
+
+// ownsVaultSecret reports whether the vault secret was claimed for this secret.
+func (s *Secret) ownsVaultSecret(metadata *hashiVault.KVMetadata) bool {
+	return metadata.CustomMetadata[vaultMetadataManagedBy] == appName &&
+		metadata.CustomMetadata[vaultMetadataSource] == s.shardKey()
+}
+
+// pushChange returns the planned change of a push to vault.
+func (s *Secret) pushChange(action changeAction, hash string) *secretChange {
+	return &secretChange{
+		Action:    action,
+		Cluster:   s.cluster,
+		Namespace: s.DestinationNamespace,
+		Name:      s.DestinationName,
+		Reason:    "push to vault " + s.source(),
+		hash:      hash,
+	}
+}
+
+// changedSecretHandler pushes a Kubernetes Secret into vault when it is created or changes, if it
+// is the source of a k8s-to-vault secret in the given cluster. The push uses a syncer from syncers,
+// so that it follows config reloads.
+func changedSecretHandler(
+	ctx context.Context,
+	l *slog.Logger,
+	syncers func() (*syncer, error),
+	cluster string,
+	hashBucket cache.HashBucket,
+	secrets func() []*Secret,
+) func(any) {
+	return func(obj any) {
+		changed, ok := obj.(*corev1.Secret)
+		if !ok {
+			return
+		}
+
+		for _, secret := range secrets() {
+			if !secret.reverse() || secret.cluster != cluster ||
+				secret.DestinationNamespace != changed.Namespace || secret.DestinationName != changed.Name {
+				continue
+			} else if !hashBucket.InBucket(secret.shardKey()) {
+				return
+			}
+
+			l := l.With(
+				slog.String(loggingKeyNamespace, secret.DestinationNamespace),
+				slog.String(loggingKeyDestination, secret.DestinationName),
+			)
+			l.Debug("Source secret changed, pushing to vault")
+
+			s, err := syncers()
+			if err != nil {
+				l.Error("Error pushing secret to vault", slog.String(loggingKeyError, err.Error()))
+				return
+			}
+
+			res, err := s.pushToVault(ctx, l, secret)
+			if err != nil {
+				l.Error("Error pushing secret to vault", slog.String(loggingKeyError, err.Error()))
+			}
+			s.status.record(secret, res, err)
+			s.logPlan(l)
+			return
+		}
+	}
+}
+
+// validateVaultWriters returns an error for every k8s-to-vault secret that writes to a vault
+// secret another secret also writes to, including one synced from more than one cluster.
+func validateVaultWriters(secrets []*Secret, clusters map[string]*clusterConfig) []error {
+	names := clusterNames(clusters)
+
+	errs := make([]error, 0)
+	writers := make(map[string]int)
+	for i, secret := range secrets {
+		if secret == nil || !secret.reverse() {
+			continue
+		}
+
+		if targets := secret.targetClusters(names); len(targets) > 1 {
+			errs = append(errs, fmt.Errorf("secrets[%d]: %w: synced from %d clusters", i, ErrDuplicateVaultWriter, len(targets)))
+		}
+
+		key := vaultDisplayName(secret.Vault) + "/" + secret.VaultNamespace + "/" + secret.source()
+		if first, ok := writers[key]; ok {
+			errs = append(errs, fmt.Errorf("secrets[%d]: %w: %s is also written by secrets[%d]", i, ErrDuplicateVaultWriter, secret.source(), first))
+			continue
+		}
+		writers[key] = i
+	}
+	return errs
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// newPushSyncer returns a syncer pushing the app Secret in the default namespace to the fake vault,
+// and the secret it is pushed as.
+func newPushSyncer(t *testing.T, vault *fakeVault, source *corev1.Secret) (*syncer, *Secret, *fake.Clientset) {
+	t.Helper()
+
+	kubeClient := fake.NewClientset()
+	if source != nil {
+		kubeClient = fake.NewClientset(source)
+	}
+
+	s := &syncer{
+		kubeClient: kubeClient,
+		vaults:     newVaultClients(t.Context(), slog.New(slog.DiscardHandler), map[string]*vaultConfig{"": vault.config(t)}),
+		hasher:     newContentHasher(nil, 1),
+		status:     newStatusStore(),
+		sources:    newSourceInformers(kubeClient),
+	}
+	secret := &Secret{
+		Mount:                "secret",
+		Name:                 "app",
+		DestinationNamespace: "default",
+		DestinationName:      "app",
+		Direction:            directionK8sToVault,
+	}
+	return s, secret, kubeClient
+}
+
+// pushSource returns the app Secret in the default namespace with the given data.
+func pushSource(data map[string][]byte) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Data:       data,
+	}
+}
+
+func TestPushToVault(t *testing.T) {
+	ctx := t.Context()
+	l := slog.New(slog.DiscardHandler)
+	vault := newFakeVault(t)
+	s, secret, kubeClient := newPushSyncer(t, vault, pushSource(map[string][]byte{"password": []byte("hunter2")}))
+
+	// The first push claims the vault secret and writes its first version.
+	res, err := s.pushToVault(ctx, l, secret)
+	if err != nil {
+		t.Fatalf("pushToVault() error = %v", err)
+	} else if res.vaultVersion != 1 {
+		t.Errorf("pushed version = %d, want 1", res.vaultVersion)
+	}
+	version, data := vault.version("secret", "app")
+	if version != 1 || data["password"] != "hunter2" {
+		t.Fatalf("vault secret = version %d %v, want version 1 with the source data", version, data)
+	}
+
+	vault.mut.Lock()
+	metadata := vault.metadata["secret/app"]
+	vault.mut.Unlock()
+	if metadata[vaultMetadataManagedBy] != appName || metadata[vaultMetadataSource] != secret.shardKey() {
+		t.Errorf("vault secret was not claimed: custom metadata = %v", metadata)
+	} else if metadata[vaultMetadataHash] != res.hash {
+		t.Errorf("recorded hash = %v, want %s", metadata[vaultMetadataHash], res.hash)
+	}
+
+	// An unchanged source is not written again.
+	if _, err := s.pushToVault(ctx, l, secret); err != nil {
+		t.Fatalf("pushToVault() error = %v", err)
+	} else if version, _ := vault.version("secret", "app"); version != 1 {
+		t.Errorf("unchanged source was written as version %d", version)
+	}
+
+	// A write made since the metadata was read fails the check-and-set, rather than being
+	// overwritten.
+	source := pushSource(map[string][]byte{"password": []byte("correct-horse")})
+	if _, err := kubeClient.CoreV1().Secrets("default").Update(ctx, source, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("updating source: %v", err)
+	}
+	vault.mut.Lock()
+	vault.racedWrites = 1
+	vault.mut.Unlock()
+	if _, err := s.pushToVault(ctx, l, secret); err == nil {
+		t.Fatal("pushToVault() overwrote a concurrent write")
+	} else if _, data := vault.version("secret", "app"); data["password"] != "hunter2" {
+		t.Errorf("vault secret was overwritten after the check-and-set failed: %v", data)
+	}
+
+	// The next push writes on top of the concurrent write.
+	res, err = s.pushToVault(ctx, l, secret)
+	if err != nil {
+		t.Fatalf("pushToVault() error = %v", err)
+	} else if res.vaultVersion != 3 {
+		t.Errorf("pushed version = %d, want 3", res.vaultVersion)
+	} else if _, data := vault.version("secret", "app"); data["password"] != "correct-horse" {
+		t.Errorf("vault secret = %v, want the updated source data", data)
+	}
+}
+
+func TestPushToVaultRefused(t *testing.T) {
+	tests := []struct {
+		name     string
+		source   *corev1.Secret
+		metadata map[string]any
+		written  bool
+		wantErr  error
+	}{
+		{
+			name:    "missing source",
+			wantErr: ErrReverseSourceMissing,
+		},
+		{
+			name: "managed source",
+			source: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "app",
+					Namespace: "default",
+					Labels:    map[string]string{secretLabelManagedBy: appName},
+				},
+				Data: map[string][]byte{"password": []byte("hunter2")},
+			},
+			wantErr: ErrReverseSourceManaged,
+		},
+		{
+			name:    "invalid content",
+			source:  pushSource(map[string][]byte{"cert": {0xff, 0xfe}}),
+			wantErr: ErrReverseInvalidContent,
+		},
+		{
+			name:    "written outside secret-sync",
+			source:  pushSource(map[string][]byte{"password": []byte("hunter2")}),
+			written: true,
+			wantErr: ErrVaultSecretNotOwned,
+		},
+		{
+			name:   "claimed by another source",
+			source: pushSource(map[string][]byte{"password": []byte("hunter2")}),
+			metadata: map[string]any{
+				vaultMetadataManagedBy: appName,
+				vaultMetadataSource:    targetKey("", "other", "app"),
+			},
+			written: true,
+			wantErr: ErrVaultSecretNotOwned,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vault := newFakeVault(t)
+			if tt.written {
+				vault.put("secret", "app", map[string]any{"password": "original"})
+			}
+			if tt.metadata != nil {
+				vault.claim("secret", "app", tt.metadata)
+			}
+
+			s, secret, _ := newPushSyncer(t, vault, tt.source)
+			if _, err := s.pushToVault(t.Context(), slog.New(slog.DiscardHandler), secret); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("pushToVault() error = %v, want %v", err, tt.wantErr)
+			}
+
+			version, data := vault.version("secret", "app")
+			if tt.written && (version != 1 || data["password"] != "original") {
+				t.Errorf("vault secret = version %d %v, want it untouched", version, data)
+			} else if !tt.written && data != nil {
+				t.Errorf("vault secret was written: %v", data)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+const (
+	// defaultRefreshJitter is the default fraction of a secret's refresh interval added at random to
+	// each sync, so that secrets loaded together do not all hit vault at once.
+	defaultRefreshJitter = 0.1
+
+	// minScheduleWait is the shortest time the scheduler sleeps between rounds.
+	minScheduleWait = time.Second
+)
+
+// scheduleEntry is the sync schedule of a single secret.
+type scheduleEntry struct {
+	// secret is the secret the entry was created for, so that its metrics can be removed with it.
+	secret *Secret
+
+	interval time.Duration
+
+	// last is when the secret was last synced, or zero if it has not been synced yet.
+	last time.Time
+	next time.Time
+}
+
+// schedule tracks when each configured secret is next due to sync. Entries are keyed by shard key,
+// so they carry over config reloads.
+type schedule struct {
+	mut     *sync.Mutex
+	entries map[string]*scheduleEntry
+}
+
+func newSchedule() *schedule {
+	return &schedule{
+		mut:     new(sync.Mutex),
+		entries: make(map[string]*scheduleEntry),
+	}
+}
+
+// due returns the configured secrets that are due to sync. Secrets seen for the first time are
+// scheduled at a random point within their jitter window, and secrets no longer configured are
+// dropped from the schedule.
+func (s *schedule) due(l *slog.Logger, now time.Time, cfg *AppConfig) []*Secret {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	due := make([]*Secret, 0)
+	configured := sets.New[string]()
+	for _, secret := range cfg.Secrets {
+		key := secret.shardKey()
+		configured.Insert(key)
+
+		interval := cfg.refreshInterval(secret)
+		entry, ok := s.entries[key]
+		switch {
+		case !ok:
+			entry = &scheduleEntry{secret: secret, interval: interval}
+			s.entries[key] = entry
+			s.reschedule(l, secret, entry, now, cfg.syncJitter)
+		case entry.interval != interval:
+			// The interval was changed by a config reload, count it from the last sync.
+			entry.interval = interval
+			s.reschedule(l, secret, entry, now, cfg.syncJitter)
+		}
+
+		if !entry.next.After(now) {
+			due = append(due, secret)
+		}
+	}
+
+	for key, entry := range s.entries {
+		if !configured.Has(key) {
+			delete(s.entries, key)
+			forgetNextSync(entry.secret)
+		}
+	}
+
+	return due
+}
+
+// synced schedules the next sync of the given secrets.
+func (s *schedule) synced(l *slog.Logger, now time.Time, cfg *AppConfig, secrets []*Secret) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	for _, secret := range secrets {
+		entry, ok := s.entries[secret.shardKey()]
+		if !ok {
+			entry = &scheduleEntry{secret: secret, interval: cfg.refreshInterval(secret)}
+			s.entries[secret.shardKey()] = entry
+		}
+		entry.last = now
+		s.reschedule(l, secret, entry, now, cfg.syncJitter)
+	}
+}
+
+// skipped pushes the given secrets, which are synced by other replicas, one interval forward, so
+// that the scheduler does not wake for them until then. Their next sync is not exported, as it is
+// not this replica's to make. A replica that takes them over syncs them when told of the change, or
+// at the latest when they are next due.
+func (s *schedule) skipped(now time.Time, secrets []*Secret) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	for _, secret := range secrets {
+		if entry, ok := s.entries[secret.shardKey()]; ok {
+			entry.next = now.Add(entry.interval)
+			forgetNextSync(entry.secret)
+		}
+	}
+}
+
+// wait returns how long until the next secret is due, at most limit and at least minScheduleWait.
+func (s *schedule) wait(now time.Time, limit time.Duration) time.Duration {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	wait := limit
+	for _, entry := range s.entries {
+		wait = min(wait, entry.next.Sub(now))
+	}
+	return max(wait, minScheduleWait)
+}
+
+// reschedule sets the next sync of the entry to one interval, plus jitter, after its last sync. An
+// entry that has never synced is due within its jitter window.
+func (s *schedule) reschedule(l *slog.Logger, secret *Secret, entry *scheduleEntry, now time.Time, jitterFraction float64) {
+	jitter := time.Duration(rand.Float64() * jitterFraction * float64(entry.interval)) // nolint:gosec // Jitter does not need a secure source
+	if entry.last.IsZero() {
+		entry.next = now.Add(jitter)
+	} else {
+		entry.next = entry.last.Add(entry.interval + jitter)
+	}
+
+	l.Debug("Secret sync scheduled",
+		slog.String(loggingKeyNamespace, secret.DestinationNamespace),
+		slog.String(loggingKeyDestination, secret.DestinationName),
+		slog.String(loggingKeyInterval, entry.interval.String()),
+		slog.Time(loggingKeyNextSync, entry.next),
+	)
+	recordNextSync(secret, entry.next)
+}
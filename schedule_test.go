@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestScheduleSkipped(t *testing.T) {
+	l := slog.New(slog.DiscardHandler)
+	now := time.Now()
+
+	mine := &Secret{Mount: "secret", Name: "mine", DestinationNamespace: "default", DestinationName: "mine"}
+	theirs := &Secret{Mount: "secret", Name: "theirs", DestinationNamespace: "default", DestinationName: "theirs"}
+	cfg := &AppConfig{
+		Secrets:      []*Secret{mine, theirs},
+		syncInterval: time.Hour,
+	}
+
+	s := newSchedule()
+	if due := s.due(l, now, cfg); len(due) != 2 {
+		t.Fatalf("due = %d secrets, want both on the first round", len(due))
+	}
+	s.synced(l, now.Add(time.Minute), cfg, []*Secret{mine})
+
+	// A due secret synced by another replica keeps the scheduler awake until it is skipped.
+	if got := s.wait(now, time.Hour); got != minScheduleWait {
+		t.Errorf("wait before skipping = %s, want %s", got, minScheduleWait)
+	}
+
+	s.skipped(now, []*Secret{theirs})
+	if got := s.wait(now, 2*time.Hour); got != time.Hour {
+		t.Errorf("wait after skipping = %s, want the interval", got)
+	}
+	if due := s.due(l, now.Add(30*time.Minute), cfg); len(due) != 0 {
+		t.Errorf("due = %v, want none until the skipped secret is checked again", due)
+	}
+	if due := s.due(l, now.Add(time.Hour), cfg); len(due) != 1 || due[0] != theirs {
+		t.Errorf("due = %v, want the skipped secret after one interval", due)
+	}
+}
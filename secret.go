@@ -5,18 +5,45 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"path"
+	"strings"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	kubeErr "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/core/v1"
 )
 
 var (
-	ErrNoMount                = errors.New("mount is required")
-	ErrNoName                 = errors.New("name is required")
-	ErrNoDestinationNamespace = errors.New("destination_namespace is required")
-	ErrNoDestinationName      = errors.New("destination_name is required")
+	ErrNoMount                     = errors.New("mount is required")
+	ErrNoName                      = errors.New("name is required")
+	ErrNoDestinationNamespace      = errors.New("destination_namespace is required")
+	ErrNoDestinationName           = errors.New("destination_name is required")
+	ErrInvalidDestinationNamespace = errors.New("destination_namespace is not a valid DNS-1123 label")
+	ErrInvalidDestinationName      = errors.New("destination_name is not a valid DNS-1123 subdomain")
+	ErrUnknownSecretType           = errors.New("unknown secret type")
+	ErrDuplicateDestination        = errors.New("duplicate destination")
+	ErrInvalidRefreshInterval      = errors.New("refresh_interval must be positive")
+)
+
+// managedSelector selects the Kubernetes Secrets managed by secret-sync.
+var managedSelector = labels.SelectorFromSet(labels.Set{secretLabelManagedBy: appName})
+
+// knownSecretTypes are the built-in Kubernetes Secret types.
+var knownSecretTypes = sets.New(
+	corev1.SecretTypeOpaque,
+	corev1.SecretTypeServiceAccountToken,
+	corev1.SecretTypeDockercfg,
+	corev1.SecretTypeDockerConfigJson,
+	corev1.SecretTypeBasicAuth,
+	corev1.SecretTypeSSHAuth,
+	corev1.SecretTypeTLS,
+	corev1.SecretTypeBootstrapToken,
 )
 
 type Secret struct {
@@ -25,24 +52,211 @@ type Secret struct {
 	DestinationNamespace string            `mapstructure:"destination_namespace"`
 	DestinationName      string            `mapstructure:"destination_name"`
 	Type                 corev1.SecretType `mapstructure:"type"` // Should be a Kubernetes Secret type
+
+	// ExclusiveName deletes any Secret with the destination name from every other namespace, not
+	// only those synced from this secret.
+	ExclusiveName bool `mapstructure:"exclusive_name"`
+
+	// RefreshInterval overrides the global refresh_interval for this secret.
+	RefreshInterval time.Duration `mapstructure:"refresh_interval"`
+
+	// Vault is the name of the vault in the vaults config to read the secret from. The vault
+	// configured under vault is used if empty.
+	Vault string `mapstructure:"vault"`
+
+	// VaultNamespace overrides the vault enterprise namespace the secret is read from.
+	VaultNamespace string `mapstructure:"vault_namespace"`
+
+	// OnSourceDeleted is what to do when the secret is deleted in vault: retain (default), delete or
+	// fallback-to-previous-version.
+	OnSourceDeleted string `mapstructure:"on_source_deleted"`
+
+	// Direction is vault-to-k8s (default), or k8s-to-vault to push the Kubernetes Secret at the
+	// destination into the vault secret instead.
+	Direction string `mapstructure:"direction"`
+
+	// Clusters are globs matched against the names of the clusters to sync the secret into. The
+	// secret is only synced into the local cluster if empty.
+	Clusters []string `mapstructure:"clusters"`
+
+	// Immutable syncs every vault version into its own immutable Secret named <destination>-v<N>,
+	// with a pointer Secret at the destination name holding the name of the current one.
+	Immutable bool `mapstructure:"immutable"`
+
+	// RetainVersions is the number of versioned Secrets kept when Immutable is set.
+	RetainVersions int `mapstructure:"retain_versions"`
+
+	// File writes the secret to a file on this host instead of a Kubernetes Secret.
+	File *fileDestination `mapstructure:"file"`
+
+	// cluster is the remote cluster this copy of the secret is synced into, or empty for the local
+	// cluster. Secrets synced into several clusters are copied for each, see expandClusters.
+	cluster string
+}
+
+// shardKey returns the key used to decide which replica owns the secret.
+func (s *Secret) shardKey() string {
+	if s.File != nil {
+		return fileKey(s.File.Path)
+	}
+	return targetKey(s.cluster, s.DestinationNamespace, s.DestinationName)
+}
+
+// filePath returns the path of the file destination, or empty if the secret is synced into
+// Kubernetes.
+func (s *Secret) filePath() string {
+	if s.File == nil {
+		return ""
+	}
+	return s.File.Path
 }
 
+// targetClusters returns the clusters, out of the given names, that the secret is synced into. The
+// local cluster is returned as the empty name.
+func (s *Secret) targetClusters(names []string) []string {
+	if len(s.Clusters) == 0 {
+		return []string{""}
+	}
+
+	targets := make([]string, 0)
+	for _, name := range names {
+		for _, pattern := range s.Clusters {
+			if ok, _ := path.Match(pattern, name); !ok {
+				continue
+			}
+
+			if name == localClusterName {
+				name = ""
+			}
+			targets = append(targets, name)
+			break
+		}
+	}
+	return targets
+}
+
+// reverse reports whether the Kubernetes Secret is pushed into vault, rather than synced from it.
+func (s *Secret) reverse() bool {
+	return s.Direction == directionK8sToVault
+}
+
+// onSourceDeleted returns the policy applied when the secret is deleted in vault.
+func (s *Secret) onSourceDeleted() string {
+	if s.OnSourceDeleted == "" {
+		return sourceDeletedRetain
+	}
+	return s.OnSourceDeleted
+}
+
+// source identifies the vault secret, recorded on the Kubernetes Secrets synced from it.
+func (s *Secret) source() string {
+	return s.Mount + "/" + s.Name
+}
+
+// syncedFrom reports whether the Kubernetes Secret is managed by secret-sync and was synced from
+// this secret.
+func (s *Secret) syncedFrom(secret *corev1.Secret) bool {
+	return managedSelector.Matches(labels.Set(secret.Labels)) &&
+		secret.Annotations[secretAnnotationSyncIdKey] != "" &&
+		secret.Annotations[secretAnnotationSource] == s.source()
+}
+
+// Valid reports every problem with the secret's configuration.
 func (s *Secret) Valid() error {
-	switch {
-	case s.Mount == "":
-		return ErrNoMount
-	case s.Name == "":
-		return ErrNoName
-	case s.DestinationNamespace == "":
-		return ErrNoDestinationNamespace
-	case s.DestinationName == "":
-		return ErrNoDestinationName
+	errs := make([]error, 0)
+	if s.Mount == "" {
+		errs = append(errs, ErrNoMount)
+	}
+	if s.Name == "" {
+		errs = append(errs, ErrNoName)
+	}
+
+	if s.File != nil {
+		if err := s.File.Valid(); err != nil {
+			errs = append(errs, unjoin(err)...)
+		}
+		if s.DestinationNamespace != "" || s.DestinationName != "" || s.Type != "" || s.ExclusiveName ||
+			s.reverse() || len(s.Clusters) > 0 {
+			errs = append(errs, fmt.Errorf("destination_namespace, destination_name, type, exclusive_name, direction k8s-to-vault and clusters are %w", ErrFileOption))
+		}
+	} else {
+		if s.DestinationNamespace == "" {
+			errs = append(errs, ErrNoDestinationNamespace)
+		} else if msgs := validation.IsDNS1123Label(s.DestinationNamespace); len(msgs) > 0 {
+			errs = append(errs, fmt.Errorf("%w: %q: %s", ErrInvalidDestinationNamespace, s.DestinationNamespace, strings.Join(msgs, "; ")))
+		}
+
+		if s.DestinationName == "" {
+			errs = append(errs, ErrNoDestinationName)
+		} else if msgs := validation.IsDNS1123Subdomain(s.DestinationName); len(msgs) > 0 {
+			errs = append(errs, fmt.Errorf("%w: %q: %s", ErrInvalidDestinationName, s.DestinationName, strings.Join(msgs, "; ")))
+		}
+	}
+
+	if s.Type != "" && !knownSecretTypes.Has(s.Type) {
+		errs = append(errs, fmt.Errorf("%w: %q", ErrUnknownSecretType, s.Type))
+	}
+
+	switch s.onSourceDeleted() {
+	case sourceDeletedRetain, sourceDeletedDelete, sourceDeletedFallback:
+	default:
+		errs = append(errs, fmt.Errorf("%w: %q", ErrUnknownSourceDeletedPolicy, s.OnSourceDeleted))
+	}
+
+	switch s.Direction {
+	case "", directionVaultToK8s:
+	case directionK8sToVault:
+		if s.ExclusiveName || s.OnSourceDeleted != "" || s.Type != "" {
+			errs = append(errs, fmt.Errorf("exclusive_name, on_source_deleted and type are %w", ErrReverseOption))
+		}
 	default:
-		return nil
+		errs = append(errs, fmt.Errorf("%w: %q", ErrUnknownDirection, s.Direction))
+	}
+
+	if s.Immutable {
+		if s.File != nil || s.reverse() {
+			errs = append(errs, fmt.Errorf("file and direction k8s-to-vault are %w", ErrImmutableOption))
+		}
+		if msgs := validation.IsValidLabelValue(s.DestinationName); len(msgs) > 0 {
+			errs = append(errs, fmt.Errorf("%w: %q: %s", ErrInvalidDestinationName, s.DestinationName, strings.Join(msgs, "; ")))
+		} else if len(s.DestinationName)+maxVersionSuffix > validation.DNS1123SubdomainMaxLength {
+			errs = append(errs, fmt.Errorf("%w: %q is too long to add a version to", ErrInvalidDestinationName, s.DestinationName))
+		}
+	}
+	if s.RetainVersions < 0 {
+		errs = append(errs, fmt.Errorf("%w: %d", ErrInvalidRetainVersions, s.RetainVersions))
+	} else if s.RetainVersions > 0 && !s.Immutable {
+		errs = append(errs, errors.New("retain_versions only applies to immutable secrets"))
+	}
+
+	for _, pattern := range s.Clusters {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("%w: %q", ErrInvalidClusterPattern, pattern))
+		}
+	}
+
+	if s.RefreshInterval < 0 {
+		errs = append(errs, fmt.Errorf("%w: %s", ErrInvalidRefreshInterval, s.RefreshInterval))
 	}
+
+	return errors.Join(errs...)
+}
+
+// upsertResult describes the outcome of an Upsert.
+type upsertResult struct {
+	// hash is the content hash recorded in the sync annotation.
+	hash string
+
+	// changed is true if the Kubernetes Secret was created or its content was updated.
+	changed bool
+
+	// migrated is true if only the sync annotation was rewritten with the current hash algorithm.
+	migrated bool
 }
 
-func (s *Secret) Upsert(ctx context.Context, kubeClient kubernetes.Interface, value map[string]any) error {
+// build returns the Kubernetes Secret for the given value, annotated with its content hash, and the
+// content the hash was computed from.
+func (s *Secret) build(value map[string]any, hasher *contentHasher) (*corev1.Secret, []byte, error) {
 	// Create a new Kubernetes Secret
 	newSecret := &corev1.Secret{
 		TypeMeta: metav1.TypeMeta{
@@ -68,45 +282,81 @@ func (s *Secret) Upsert(ctx context.Context, kubeClient kubernetes.Interface, va
 		newSecret.Data[vk] = []byte(fmt.Sprintf("%v", vv))
 	}
 	if len(newSecret.Data) == 0 {
-		return errors.New("no data found in secret")
+		return nil, nil, errors.New("no data found in secret")
 	}
 
 	// Add an annotation with the hash of the Secret
-	hashBytes, err := json.Marshal(newSecret)
+	content, err := json.Marshal(newSecret)
 	if err != nil {
-		return fmt.Errorf("error marshalling secret data: %w", err)
+		return nil, nil, fmt.Errorf("error marshalling secret data: %w", err)
 	}
-	hash := shaHash(hashBytes)
-	newSecret.Annotations[secretAnnotationSyncIdKey] = hash
+	newSecret.Annotations[secretAnnotationSyncIdKey] = hasher.sum(content)
+
+	// The source is not part of the hash, so that adding it does not change the hash of secrets
+	// synced before it was recorded.
+	newSecret.Annotations[secretAnnotationSource] = s.source()
+
+	return newSecret, content, nil
+}
+
+// Upsert creates or updates the destination Kubernetes Secret with the given value. The existing
+// secret is read from the lister, or from the API server if the lister has not seen it. A secret whose sync annotation was recorded with another hash
+// algorithm is left alone while its content is up to date, until the hasher allows it to migrate.
+func (s *Secret) Upsert(
+	ctx context.Context,
+	kubeClient kubernetes.Interface,
+	lister listersv1.SecretLister,
+	hasher *contentHasher,
+	value map[string]any,
+) (*upsertResult, error) {
+	newSecret, content, err := s.build(value, hasher)
+	if err != nil {
+		return nil, err
+	}
+	hash := newSecret.Annotations[secretAnnotationSyncIdKey]
 
 	// Does the secret already exist?
-	existingSecret, err := kubeClient.CoreV1().Secrets(s.DestinationNamespace).Get(ctx, s.DestinationName, metav1.GetOptions{
-		TypeMeta: metav1.TypeMeta{
-			Kind: "Secret",
-		},
-	})
+	cachedSecret, err := lister.Secrets(s.DestinationNamespace).Get(s.DestinationName)
 	if err != nil && kubeErr.IsNotFound(err) {
-		// Try to create the Secret first
+		// Try to create the Secret first.
 		_, err = kubeClient.CoreV1().Secrets(s.DestinationNamespace).Create(ctx, newSecret, metav1.CreateOptions{})
+		if err == nil {
+			return &upsertResult{hash: hash, changed: true}, nil
+		} else if !kubeErr.IsAlreadyExists(err) {
+			return nil, fmt.Errorf("error creating secret: %w", err)
+		}
+
+		// The lister only holds managed Secrets, but it may not have seen one created here yet. The
+		// Secret is read live to tell the two apart.
+		cachedSecret, err = kubeClient.CoreV1().Secrets(s.DestinationNamespace).Get(ctx, s.DestinationName, metav1.GetOptions{})
 		if err != nil {
-			return fmt.Errorf("error creating secret: %w", err)
+			return nil, fmt.Errorf("error getting existing secret: %w", err)
 		}
-		return nil
 	} else if err != nil {
-		return fmt.Errorf("error getting existing secret: %w", err)
+		return nil, fmt.Errorf("error getting existing secret: %w", err)
 	}
 
-	if existingSecret.Labels == nil {
-		existingSecret.Labels = make(map[string]string)
-	} else if existingSecret.Labels[secretLabelManagedBy] != appName {
-		return fmt.Errorf("secret %s/%s is not managed by %s", s.DestinationNamespace, s.DestinationName, appName)
+	// Never modify the cached object
+	existingSecret := cachedSecret.DeepCopy()
+	if existingSecret.Labels[secretLabelManagedBy] != appName {
+		return nil, fmt.Errorf("secret %s/%s is not managed by %s", s.DestinationNamespace, s.DestinationName, appName)
 	}
 
-	if existingSecret.Annotations == nil {
-		existingSecret.Annotations = make(map[string]string)
-	} else if existingSecret.Annotations[secretAnnotationSyncIdKey] == hash {
+	existingHash := existingSecret.Annotations[secretAnnotationSyncIdKey]
+	// A Secret whose annotation was recorded under another hashing key is not changed while its
+	// content is the same, its annotation is migrated instead.
+	changed := !hasher.matches(existingHash, content) && !sameContent(existingSecret, newSecret)
+	migrated := !changed && existingHash != hash
+	if !changed && existingSecret.Annotations[secretAnnotationSource] == s.source() &&
+		(!migrated || !hasher.migrate()) {
 		// The secret already exists and is up to date
-		return nil
+		return &upsertResult{hash: existingHash, changed: false}, nil
+	}
+
+	for _, key := range controlAnnotations {
+		if value, ok := existingSecret.Annotations[key]; ok {
+			newSecret.Annotations[key] = value
+		}
 	}
 
 	existingSecret.Labels = newSecret.Labels
@@ -116,8 +366,57 @@ func (s *Secret) Upsert(ctx context.Context, kubeClient kubernetes.Interface, va
 
 	_, err = kubeClient.CoreV1().Secrets(s.DestinationNamespace).Update(ctx, existingSecret, metav1.UpdateOptions{})
 	if err != nil {
-		return fmt.Errorf("error updating secret: %w", err)
+		return nil, fmt.Errorf("error updating secret: %w", err)
+	}
+
+	return &upsertResult{hash: hash, changed: changed, migrated: migrated}, nil
+}
+
+// Diff describes the change an Upsert with the given value would make, without making it. Like
+// Upsert, a Secret the lister has not seen is read from the API server, and a Secret that exists but
+// is not managed is reported as a conflict.
+func (s *Secret) Diff(
+	ctx context.Context,
+	kubeClient kubernetes.Interface,
+	lister listersv1.SecretLister,
+	hasher *contentHasher,
+	value map[string]any,
+) (*secretChange, error) {
+	newSecret, content, err := s.build(value, hasher)
+	if err != nil {
+		return nil, err
+	}
+
+	change := &secretChange{
+		Action:    changeActionUnchanged,
+		Cluster:   s.cluster,
+		Namespace: s.DestinationNamespace,
+		Name:      s.DestinationName,
+		hash:      newSecret.Annotations[secretAnnotationSyncIdKey],
+	}
+
+	existingSecret, err := lister.Secrets(s.DestinationNamespace).Get(s.DestinationName)
+	if kubeErr.IsNotFound(err) {
+		existingSecret, err = kubeClient.CoreV1().Secrets(s.DestinationNamespace).Get(ctx, s.DestinationName, metav1.GetOptions{})
+	}
+	if kubeErr.IsNotFound(err) {
+		change.Action = changeActionCreate
+		change.Added = sortedKeys(newSecret.Data)
+		return change, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error getting existing secret: %w", err)
+	}
+
+	if existingSecret.Labels[secretLabelManagedBy] != appName {
+		change.Action = changeActionConflict
+		change.Reason = "not managed by " + appName
+		return change, nil
+	} else if hasher.matches(existingSecret.Annotations[secretAnnotationSyncIdKey], content) ||
+		sameContent(existingSecret, newSecret) {
+		return change, nil
 	}
 
-	return nil
+	change.Action = changeActionUpdate
+	change.Added, change.Removed, change.Changed = diffKeys(existingSecret.Data, newSecret.Data)
+	return change, nil
 }
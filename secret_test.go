@@ -0,0 +1,208 @@
+package main
+
+import (
+	"log/slog"
+	"strconv"
+	"strings"
+	"testing"
+
+	hashiVault "github.com/hashicorp/vault/api"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// emptySecretLister returns a lister that has not seen any Secret, as when the informer lags behind.
+func emptySecretLister() listersv1.SecretLister {
+	return listersv1.NewSecretLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}))
+}
+
+func TestUpsertMissedByLister(t *testing.T) {
+	tests := []struct {
+		name    string
+		labels  map[string]string
+		wantErr string
+	}{
+		{
+			name:   "managed",
+			labels: map[string]string{secretLabelManagedBy: appName},
+		},
+		{
+			name:    "unmanaged",
+			labels:  map[string]string{"owner": "someone-else"},
+			wantErr: "is not managed by",
+		},
+		{
+			name:    "unlabelled",
+			wantErr: "is not managed by",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kubeClient := fake.NewClientset(&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "app",
+					Namespace: "default",
+					Labels:    tt.labels,
+				},
+				Data: map[string][]byte{"password": []byte("old")},
+			})
+
+			secret := &Secret{Mount: "secret", Name: "app", DestinationNamespace: "default", DestinationName: "app"}
+			res, err := secret.Upsert(
+				t.Context(),
+				kubeClient,
+				emptySecretLister(),
+				newContentHasher(nil, 1),
+				map[string]any{"password": "new"},
+			)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Upsert() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("Upsert() error = %v", err)
+			} else if !res.changed {
+				t.Error("Upsert() did not report the update")
+			}
+
+			got, err := kubeClient.CoreV1().Secrets("default").Get(t.Context(), "app", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("getting secret: %v", err)
+			} else if string(got.Data["password"]) != "new" {
+				t.Errorf("password = %q, want the updated value", got.Data["password"])
+			}
+		})
+	}
+}
+
+func TestDiffMissedByLister(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing *corev1.Secret
+		want     changeAction
+	}{
+		{
+			name: "missing",
+			want: changeActionCreate,
+		},
+		{
+			name: "managed",
+			existing: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "app",
+					Namespace: "default",
+					Labels:    map[string]string{secretLabelManagedBy: appName},
+				},
+				Data: map[string][]byte{"password": []byte("old")},
+			},
+			want: changeActionUpdate,
+		},
+		{
+			name: "unmanaged",
+			existing: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+				Data:       map[string][]byte{"password": []byte("old")},
+			},
+			want: changeActionConflict,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kubeClient := fake.NewClientset()
+			if tt.existing != nil {
+				kubeClient = fake.NewClientset(tt.existing)
+			}
+
+			secret := &Secret{Mount: "secret", Name: "app", DestinationNamespace: "default", DestinationName: "app"}
+			change, err := secret.Diff(
+				t.Context(),
+				kubeClient,
+				emptySecretLister(),
+				newContentHasher(nil, 1),
+				map[string]any{"password": "new"},
+			)
+			if err != nil {
+				t.Fatalf("Diff() error = %v", err)
+			} else if change.Action != tt.want {
+				t.Errorf("Diff() action = %s, want %s", change.Action, tt.want)
+			}
+		})
+	}
+}
+
+func TestHashingKeyRotation(t *testing.T) {
+	ctx := t.Context()
+	oldHasher := newContentHasher([]byte(strings.Repeat("a", 32)), 1)
+	newHasher := newContentHasher([]byte(strings.Repeat("b", 32)), 1)
+	value := map[string]any{"password": "hunter2"}
+
+	t.Run("mutable", func(t *testing.T) {
+		secret := &Secret{Mount: "secret", Name: "app", DestinationNamespace: "default", DestinationName: "app"}
+		existing, _, err := secret.build(value, oldHasher)
+		if err != nil {
+			t.Fatalf("building secret: %v", err)
+		}
+		kubeClient := fake.NewClientset(existing)
+
+		res, err := secret.Upsert(ctx, kubeClient, emptySecretLister(), newHasher, value)
+		if err != nil {
+			t.Fatalf("Upsert() error = %v", err)
+		} else if res.changed {
+			t.Error("Upsert() reported a change after the hashing key was rotated")
+		} else if !res.migrated {
+			t.Error("Upsert() did not migrate the annotation to the new key")
+		}
+	})
+
+	t.Run("immutable", func(t *testing.T) {
+		secret := &Secret{
+			Mount:                "secret",
+			Name:                 "app",
+			DestinationNamespace: "default",
+			DestinationName:      "app",
+			Immutable:            true,
+		}
+		version, _, err := secret.buildVersion(value, 1, oldHasher)
+		if err != nil {
+			t.Fatalf("building version: %v", err)
+		}
+		pointer, _, err := secret.pointer().build(map[string]any{
+			pointerKeyName:    version.Name,
+			pointerKeyVersion: strconv.Itoa(1),
+		}, oldHasher)
+		if err != nil {
+			t.Fatalf("building pointer: %v", err)
+		}
+
+		kubeClient := fake.NewClientset(version, pointer)
+		indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+		for _, obj := range []*corev1.Secret{version, pointer} {
+			if err := indexer.Add(obj); err != nil {
+				t.Fatalf("adding %s to the lister: %v", obj.Name, err)
+			}
+		}
+
+		s := &syncer{
+			kubeClient:   kubeClient,
+			secretLister: listersv1.NewSecretLister(indexer),
+			hasher:       newHasher,
+		}
+		_, err = s.upsertVersioned(ctx, slog.New(slog.DiscardHandler), secret, &hashiVault.KVSecret{
+			Data:            value,
+			VersionMetadata: &hashiVault.KVVersionMetadata{Version: 1},
+		})
+		if err != nil {
+			t.Fatalf("upsertVersioned() error = %v", err)
+		}
+
+		for _, action := range kubeClient.Actions() {
+			if action.GetVerb() == "delete" || action.GetVerb() == "create" {
+				t.Errorf("version was replaced after the hashing key was rotated: %s %s", action.GetVerb(), action.GetResource().Resource)
+			}
+		}
+	})
+}
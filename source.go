@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+
+	hashiVault "github.com/hashicorp/vault/api"
+	"github.com/jacobbrewer1/vaulty"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// sourceDeletedRetain keeps the Kubernetes Secret as it is, warning that its source is gone.
+	sourceDeletedRetain = "retain"
+
+	// sourceDeletedDelete deletes the Kubernetes Secret.
+	sourceDeletedDelete = "delete"
+
+	// sourceDeletedFallback syncs the newest version of the vault secret that has not been deleted.
+	sourceDeletedFallback = "fallback-to-previous-version"
+
+	// eventReasonSourceDeleted is the reason of the event emitted when a secret's source is deleted.
+	eventReasonSourceDeleted = "SourceDeleted"
+)
+
+var (
+	ErrSourceDeleted              = errors.New("secret deleted in vault")
+	ErrNoPreviousVersion          = errors.New("no previous version available")
+	ErrUnknownSourceDeletedPolicy = errors.New("unknown on_source_deleted policy")
+)
+
+// readFromVault reads the latest version of the secret from vault. It returns ErrSourceDeleted if
+// the path does not exist or its latest version has been deleted or destroyed, so that it can be
+// told apart from permission and network errors.
+func (s *syncer) readFromVault(ctx context.Context, secret *Secret) (*hashiVault.KVSecret, error) {
+	vaultClient, err := s.vaults.forSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	vaultSecret, err := vaultClient.Path(
+		secret.Name,
+		vaulty.WithMount(secret.Mount),
+	).GetKvSecretV2(ctx)
+	switch {
+	case errors.Is(err, vaulty.ErrSecretNotFound):
+		return nil, fmt.Errorf("%w: %w", ErrSourceDeleted, err)
+	case err != nil:
+		return nil, err
+	case vaultSecret.Data == nil:
+		// Deleted and destroyed versions are returned with their metadata only.
+		return nil, fmt.Errorf("%w: version %d", ErrSourceDeleted, vaultVersion(vaultSecret))
+	}
+	return vaultSecret, nil
+}
+
+// previousVersion returns the newest version of the secret that has not been deleted or destroyed.
+func (s *syncer) previousVersion(ctx context.Context, secret *Secret) (*hashiVault.KVSecret, error) {
+	vaultClient, err := s.vaults.forSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, err := vaultClient.Client().KVv2(secret.Mount).GetMetadata(ctx, secret.Name)
+	if err != nil {
+		return nil, fmt.Errorf("error getting secret metadata: %w", err)
+	}
+
+	version := 0
+	for key, v := range metadata.Versions {
+		n, err := strconv.Atoi(key)
+		if err != nil || v.Destroyed || !v.DeletionTime.IsZero() {
+			continue
+		}
+		version = max(version, n)
+	}
+	if version == 0 {
+		return nil, ErrNoPreviousVersion
+	}
+
+	vaultSecret, err := vaultClient.Path(
+		secret.Name,
+		vaulty.WithMount(secret.Mount),
+		vaulty.WithVersion(uint(version)), // nolint:gosec // Versions are positive
+	).GetKvSecretV2(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting version %d: %w", version, err)
+	} else if vaultSecret.Data == nil {
+		return nil, fmt.Errorf("%w: version %d was deleted", ErrNoPreviousVersion, version)
+	}
+	return vaultSecret, nil
+}
+
+// sourceDeleted applies the secret's on_source_deleted policy. It returns the vault secret to sync
+// instead when falling back to a previous version.
+func (s *syncer) sourceDeleted(
+	ctx context.Context,
+	l *slog.Logger,
+	secret *Secret,
+	sourceErr error,
+) (*hashiVault.KVSecret, error) {
+	switch secret.onSourceDeleted() {
+	case sourceDeletedFallback:
+		vaultSecret, err := s.previousVersion(ctx, secret)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", sourceErr, err)
+		}
+		l.Warn("Secret deleted in vault, syncing previous version", slog.Int(loggingKeyVersion, vaultVersion(vaultSecret)))
+		return vaultSecret, nil
+	case sourceDeletedDelete:
+		l.Warn("Secret deleted in vault, deleting destination")
+		s.removeSecret(ctx, l, secret, "source deleted in vault")
+		return nil, sourceErr
+	default:
+		// Only warn when the source is first found to be deleted, not on every sync.
+		if st, _ := s.status.get(secret); st.SourceDeleted || s.plan != nil {
+			return nil, sourceErr
+		}
+
+		l.Warn("Secret deleted in vault, retaining destination")
+		if secret.File != nil {
+			// There is no Kubernetes object to record the event on.
+			return nil, sourceErr
+		} else if err := emitWarning(ctx, s.kubeClient, secret, eventReasonSourceDeleted,
+			fmt.Sprintf("Vault secret %s was deleted, keeping the last synced data", secret.source()),
+		); err != nil {
+			l.Error("Error emitting event", slog.String(loggingKeyError, err.Error()))
+		}
+		return nil, sourceErr
+	}
+}
+
+// emitWarning records a warning event on the destination Kubernetes Secret.
+func emitWarning(ctx context.Context, kubeClient kubernetes.Interface, secret *Secret, reason, message string) error {
+	now := metav1.Now()
+	_, err := kubeClient.CoreV1().Events(secret.DestinationNamespace).Create(ctx, &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: secret.DestinationName + "-",
+			Namespace:    secret.DestinationNamespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Secret",
+			Namespace:  secret.DestinationNamespace,
+			Name:       secret.DestinationName,
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           corev1.EventTypeWarning,
+		Source:         corev1.EventSource{Component: appName},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("error creating event: %w", err)
+	}
+	return nil
+}
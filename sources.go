@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	coreErr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/sets"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	kubeCache "k8s.io/client-go/tools/cache"
+)
+
+// sourceInformer watches a single source Secret.
+type sourceInformer struct {
+	informer kubeCache.SharedIndexInformer
+	cancel   context.CancelFunc
+}
+
+// sourceInformers watches the source Secrets of k8s-to-vault secrets in a cluster. Sources are not
+// managed by secret-sync, so they are not in the managed Secret informer. Each is watched by its own
+// informer narrowed to its namespace and name instead, so that no other Secret is read.
+type sourceInformers struct {
+	mut *sync.Mutex
+
+	// ctx stops every informer, nothing is watched until it is set by start.
+	ctx        context.Context
+	kubeClient kubernetes.Interface
+
+	// informers are keyed by the namespace and name of their source.
+	informers map[string]*sourceInformer
+
+	// handlers are added to every informer.
+	handlers []kubeCache.ResourceEventHandler
+}
+
+func newSourceInformers(kubeClient kubernetes.Interface) *sourceInformers {
+	return &sourceInformers{
+		mut:        new(sync.Mutex),
+		kubeClient: kubeClient,
+		informers:  make(map[string]*sourceInformer),
+		handlers:   make([]kubeCache.ResourceEventHandler, 0),
+	}
+}
+
+// start allows sources to be watched, until ctx is cancelled.
+func (s *sourceInformers) start(ctx context.Context) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.ctx = ctx
+}
+
+// addEventHandler adds the handler to the informer of every source, including those watched later.
+func (s *sourceInformers) addEventHandler(handler kubeCache.ResourceEventHandler) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	for _, si := range s.informers {
+		if _, err := si.informer.AddEventHandler(handler); err != nil {
+			return err
+		}
+	}
+	s.handlers = append(s.handlers, handler)
+	return nil
+}
+
+// update watches the given sources, keyed by namespace and name, and stops watching every other.
+func (s *sourceInformers) update(keys sets.Set[string]) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if s.ctx == nil {
+		return nil
+	}
+
+	for key, si := range s.informers {
+		if !keys.Has(key) {
+			si.cancel()
+			delete(s.informers, key)
+		}
+	}
+
+	for key := range keys {
+		if _, ok := s.informers[key]; ok {
+			continue
+		}
+
+		namespace, name, err := kubeCache.SplitMetaNamespaceKey(key)
+		if err != nil {
+			return fmt.Errorf("error splitting source key: %w", err)
+		}
+
+		informer := coreinformers.NewFilteredSecretInformer(
+			s.kubeClient,
+			namespace,
+			informerResync,
+			kubeCache.Indexers{},
+			func(opts *metav1.ListOptions) {
+				opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+			},
+		)
+		for _, handler := range s.handlers {
+			if _, err := informer.AddEventHandler(handler); err != nil {
+				return err
+			}
+		}
+
+		ctx, cancel := context.WithCancel(s.ctx)
+		s.informers[key] = &sourceInformer{informer: informer, cancel: cancel}
+		go informer.Run(ctx.Done())
+	}
+	return nil
+}
+
+// get returns the source Secret, from its informer once its cache has synced and otherwise from the
+// API server.
+func (s *sourceInformers) get(ctx context.Context, namespace, name string) (*corev1.Secret, error) {
+	key := secretKey(namespace, name)
+
+	s.mut.Lock()
+	si, ok := s.informers[key]
+	s.mut.Unlock()
+
+	if !ok || !si.informer.HasSynced() {
+		return s.kubeClient.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	}
+
+	obj, exists, err := si.informer.GetStore().GetByKey(key)
+	if err != nil {
+		return nil, err
+	} else if !exists {
+		return nil, coreErr.NewNotFound(corev1.Resource("secrets"), name)
+	}
+
+	secret, ok := obj.(*corev1.Secret)
+	if !ok {
+		return nil, fmt.Errorf("unexpected object in source informer: %T", obj)
+	}
+	return secret, nil
+}
+
+// sourceKeys returns the namespace and name of the source of every k8s-to-vault secret in the
+// given cluster.
+func sourceKeys(secrets []*Secret, cluster string) sets.Set[string] {
+	keys := sets.New[string]()
+	for _, secret := range secrets {
+		if secret.reverse() && secret.cluster == cluster {
+			keys.Insert(secretKey(secret.DestinationNamespace, secret.DestinationName))
+		}
+	}
+	return keys
+}
+
+// watchSources watches the sources of the k8s-to-vault secrets in the local cluster and in every
+// connected remote cluster.
+func (a *App) watchSources(l *slog.Logger) {
+	secrets := a.currentConfig().Secrets
+	if a.sources != nil {
+		if err := a.sources.update(sourceKeys(secrets, "")); err != nil {
+			l.Error("Error watching source secrets", slog.String(loggingKeyError, err.Error()))
+		}
+	}
+
+	for name, c := range a.clusters.connected() {
+		if err := c.sources.update(sourceKeys(secrets, name)); err != nil {
+			l.Error("Error watching source secrets",
+				slog.String(loggingKeyCluster, name),
+				slog.String(loggingKeyError, err.Error()),
+			)
+		}
+	}
+}
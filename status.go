@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	hashiVault "github.com/hashicorp/vault/api"
+)
+
+type (
+	// syncResult is the outcome of a successful read from vault and upsert into Kubernetes.
+	syncResult struct {
+		vaultVersion int
+		hash         string
+
+		// paused is set when nothing was written as the destination is paused.
+		paused bool
+	}
+
+	// secretStatus is the last known sync state of a configured secret.
+	secretStatus struct {
+		Cluster      string    `json:"cluster,omitempty"`
+		Namespace    string    `json:"namespace"`
+		Name         string    `json:"name"`
+		Path         string    `json:"path,omitempty"`
+		Owner        string    `json:"owner,omitempty"`
+		LastSync     time.Time `json:"last_sync,omitzero"`
+		VaultVersion int       `json:"vault_version,omitempty"`
+		Hash         string    `json:"hash,omitempty"`
+		LastError    string    `json:"last_error,omitempty"`
+
+		// SourceDeleted is set while the secret is deleted in vault.
+		SourceDeleted bool `json:"source_deleted,omitempty"`
+
+		// PolicyViolation is set while syncing the secret is refused by policy.
+		PolicyViolation bool `json:"policy_violation,omitempty"`
+
+		// PinnedVersion is the vault version the secret is pinned to, if any.
+		PinnedVersion int `json:"pinned_version,omitempty"`
+
+		// Paused is set while the destination is paused and nothing is written to it.
+		Paused bool `json:"paused,omitempty"`
+	}
+
+	// statusStore holds the sync state of every secret reconciled by this replica.
+	statusStore struct {
+		mut      *sync.RWMutex
+		statuses map[string]secretStatus
+	}
+)
+
+func newStatusStore() *statusStore {
+	return &statusStore{
+		mut:      new(sync.RWMutex),
+		statuses: make(map[string]secretStatus),
+	}
+}
+
+// record stores the outcome of a sync attempt. A failed attempt keeps the details of the last
+// successful sync so that the status shows both what is deployed and why it is not progressing.
+func (s *statusStore) record(secret *Secret, res *syncResult, err error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	key := secret.shardKey()
+	st := s.statuses[key]
+	st.Cluster = secret.cluster
+	st.Namespace = secret.DestinationNamespace
+	st.Name = secret.DestinationName
+	st.Path = secret.filePath()
+	st.SourceDeleted = errors.Is(err, ErrSourceDeleted)
+	st.PolicyViolation = errors.Is(err, ErrPolicyViolation)
+	st.Paused = res != nil && res.paused
+
+	if err != nil {
+		st.LastError = err.Error()
+		s.statuses[key] = st
+		return
+	} else if st.Paused {
+		// The last sync is still what is deployed.
+		st.LastError = ""
+		s.statuses[key] = st
+		return
+	}
+
+	st.LastSync = time.Now().UTC()
+	st.LastError = ""
+	if res != nil {
+		st.VaultVersion = res.vaultVersion
+		st.Hash = res.hash
+	}
+	s.statuses[key] = st
+}
+
+// get returns the status of the given secret, and whether this replica has ever synced it.
+func (s *statusStore) get(secret *Secret) (secretStatus, bool) {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+
+	st, ok := s.statuses[secret.shardKey()]
+	if !ok {
+		return secretStatus{
+			Cluster:   secret.cluster,
+			Namespace: secret.DestinationNamespace,
+			Name:      secret.DestinationName,
+			Path:      secret.filePath(),
+		}, false
+	}
+	return st, true
+}
+
+// pin records the vault version the secret is pinned to, 0 if it is not, and reports whether it
+// changed.
+func (s *statusStore) pin(secret *Secret, version int) bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	key := secret.shardKey()
+	st, ok := s.statuses[key]
+	if !ok && version == 0 {
+		return false
+	} else if !ok {
+		st = secretStatus{
+			Cluster:   secret.cluster,
+			Namespace: secret.DestinationNamespace,
+			Name:      secret.DestinationName,
+		}
+	}
+
+	changed := st.PinnedVersion != version
+	st.PinnedVersion = version
+	s.statuses[key] = st
+	return changed
+}
+
+// forget removes the status of a secret that is no longer configured.
+func (s *statusStore) forget(secret *Secret) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	delete(s.statuses, secret.shardKey())
+}
+
+// key returns the key of the secret the status belongs to, matching its shard key.
+func (st *secretStatus) key() string {
+	if st.Path != "" {
+		return fileKey(st.Path)
+	}
+	return targetKey(st.Cluster, st.Namespace, st.Name)
+}
+
+// secretKey returns the namespace/name key of a destination secret.
+func secretKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+// targetKey returns the key of a destination secret in the given cluster. Secrets in the local
+// cluster are keyed by namespace/name.
+func targetKey(cluster, namespace, name string) string {
+	if cluster == "" {
+		return secretKey(namespace, name)
+	}
+	return cluster + "/" + secretKey(namespace, name)
+}
+
+// vaultVersion returns the KV v2 version of the given secret, or 0 if it is unknown.
+func vaultVersion(vaultSecret *hashiVault.KVSecret) int {
+	if vaultSecret == nil || vaultSecret.VersionMetadata == nil {
+		return 0
+	}
+	return vaultSecret.VersionMetadata.Version
+}
@@ -3,52 +3,179 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log/slog"
 	"time"
 
-	"github.com/jacobbrewer1/vaulty"
+	hashiVault "github.com/hashicorp/vault/api"
 	"github.com/jacobbrewer1/web"
 	"github.com/jacobbrewer1/web/cache"
 	corev1 "k8s.io/api/core/v1"
 	coreErr "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/core/v1"
 	kubeCache "k8s.io/client-go/tools/cache"
 )
 
+// syncer reconciles configured secrets from vault into Kubernetes. Its clients and listers reach
+// the local cluster, see forCluster for the remote clusters.
+type syncer struct {
+	kubeClient kubernetes.Interface
+	vaults     *vaultClients
+	clusters   *kubeClusters
+	hasher     *contentHasher
+	status     *statusStore
+	reload     *reloader
+
+	// pendingReloads are the file destinations whose consumer has not been reloaded since they were
+	// written.
+	pendingReloads *pendingReloads
+
+	// secretLister and namespaceLister serve reads from the informer caches, so that only writes
+	// reach the API server. The secret lister only holds managed Secrets, sources holds the Secrets
+	// pushed into vault.
+	secretLister    listersv1.SecretLister
+	namespaceLister listersv1.NamespaceLister
+	sources         *sourceInformers
+
+	// policies are checked before every secret is written.
+	policies []*policy
+
+	// plan, when set, collects the changes a sync would make instead of making them.
+	plan *changeSet
+}
+
+// newSyncer returns a syncer using the application's clients. Changes are only planned when the
+// configuration requests a dry run.
+func (a *App) newSyncer() *syncer {
+	s := &syncer{
+		kubeClient: a.kubeClient,
+		vaults:     a.vaults,
+		clusters:   a.clusters,
+		hasher:     a.hasher,
+		status:     a.status,
+		reload:     a.reloader,
+
+		pendingReloads: a.pendingReloads,
+
+		policies: a.currentConfig().policies,
+	}
+	if a.informers != nil {
+		s.secretLister = a.informers.Core().V1().Secrets().Lister()
+		s.namespaceLister = a.informers.Core().V1().Namespaces().Lister()
+		s.sources = a.sources
+	}
+	if a.currentConfig().dryRun {
+		s.plan = newChangeSet()
+	}
+	return s
+}
+
+// forCluster returns a syncer writing to the named cluster, sharing the vault clients, status and
+// plan of this one. The empty name is the local cluster.
+func (s *syncer) forCluster(name string) (*syncer, error) {
+	if name == "" && s.kubeClient == nil {
+		return nil, ErrKubernetesNotConnected
+	} else if name == "" {
+		return s, nil
+	}
+
+	c, err := s.clusters.get(name)
+	if err != nil {
+		return nil, err
+	}
+
+	cs := *s
+	cs.kubeClient = c.kubeClient
+	cs.reload = c.reload
+	cs.secretLister = c.informers.Core().V1().Secrets().Lister()
+	cs.namespaceLister = c.informers.Core().V1().Namespaces().Lister()
+	cs.sources = c.sources
+	return &cs, nil
+}
+
 func (a *App) watchSecrets(
 	l *slog.Logger,
 ) web.AsyncTaskFunc {
 	return func(ctx context.Context) {
-		secretInformer := a.base.SecretInformer()
-
-		if _, err := secretInformer.AddEventHandler(kubeCache.ResourceEventHandlerFuncs{
-			AddFunc:    nil,
-			UpdateFunc: nil,
-			DeleteFunc: deletedSecretHandler(
-				ctx,
-				l,
-				a.base.KubeClient(),
-				a.base.VaultClient(),
-				a.base.ServiceEndpointHashBucket(),
-				a.config.Secrets,
-			),
-		}); err != nil {
-			l.Error("Error adding event handler", slog.String(loggingKeyError, err.Error()))
-			return
+		watch := func(cluster string, secretInformer kubeCache.SharedIndexInformer, sources *sourceInformers) error {
+			l := l
+			if cluster != "" {
+				l = l.With(slog.String(loggingKeyCluster, cluster))
+			}
+
+			// Every event is handled with the policies and dry run of the current config.
+			syncers := func() (*syncer, error) { return a.newSyncer().forCluster(cluster) }
+			secrets := func() []*Secret { return a.currentConfig().Secrets }
+			onChange := changedSecretHandler(ctx, l, syncers, cluster, a.hashBucket(), secrets)
+			onControlChange := controlChangedHandler(ctx, l, syncers, cluster, a.hashBucket(), secrets)
+
+			// Periodic resyncs deliver updates without changes.
+			changed := func(oldObj, newObj any) bool {
+				oldSecret, ok := oldObj.(*corev1.Secret)
+				newSecret, ok2 := newObj.(*corev1.Secret)
+				return !ok || !ok2 || oldSecret.ResourceVersion != newSecret.ResourceVersion
+			}
+
+			if _, err := secretInformer.AddEventHandler(kubeCache.ResourceEventHandlerFuncs{
+				UpdateFunc: func(oldObj, newObj any) {
+					if changed(oldObj, newObj) {
+						onControlChange(oldObj, newObj)
+					}
+				},
+				DeleteFunc: deletedSecretHandler(ctx, l, syncers, cluster, a.hashBucket(), secrets),
+			}); err != nil {
+				return err
+			}
+
+			return sources.addEventHandler(kubeCache.ResourceEventHandlerFuncs{
+				AddFunc: onChange,
+				UpdateFunc: func(oldObj, newObj any) {
+					if changed(oldObj, newObj) {
+						onChange(newObj)
+					}
+				},
+			})
+		}
+
+		// The informers are not set up when only files are written.
+		if a.informers != nil {
+			if err := watch("", a.informers.Core().V1().Secrets().Informer(), a.sources); err != nil {
+				l.Error("Error adding event handler", slog.String(loggingKeyError, err.Error()))
+				return
+			}
 		}
 
-		secretInformer.Run(ctx.Done())
+		// Remote clusters are watched once connected. The handler stops with the cluster's informers.
+		a.clusters.watch(func(name string, c *kubeCluster) {
+			err := watch(name, c.informers.Core().V1().Secrets().Informer(), c.sources)
+			if err == nil {
+				err = c.sources.update(sourceKeys(a.currentConfig().Secrets, name))
+			}
+			if err != nil {
+				l.Error("Error adding event handler",
+					slog.String(loggingKeyCluster, name),
+					slog.String(loggingKeyError, err.Error()),
+				)
+			}
+		})
+		a.watchSources(l)
+
+		<-ctx.Done()
 	}
 }
 
 func deletedSecretHandler(
 	ctx context.Context,
 	l *slog.Logger,
-	kubeClient kubernetes.Interface,
-	vaultClient vaulty.Client,
+	syncers func() (*syncer, error),
+	cluster string,
 	hashBucket cache.HashBucket,
-	secrets []*Secret,
+	secrets func() []*Secret,
 ) func(any) {
 	return func(obj any) {
 		secret, ok := obj.(*corev1.Secret)
@@ -56,11 +183,17 @@ func deletedSecretHandler(
 			return
 		}
 
-		if !hashBucket.InBucket(secret.Name) {
+		// Versioned Secrets are deleted when old versions are pruned, which must not sync the secret
+		// again. A deleted current version is recreated by the secret's next scheduled sync.
+		if _, ok := secret.Labels[secretLabelVersion]; ok {
 			return
 		}
 
-		l = l.With(
+		if !hashBucket.InBucket(targetKey(cluster, secret.Namespace, secret.Name)) {
+			return
+		}
+
+		l := l.With(
 			slog.String(loggingKeyNamespace, secret.Namespace),
 			slog.String(loggingKeyDestination, secret.Name),
 		)
@@ -71,6 +204,9 @@ func deletedSecretHandler(
 			return
 		} else if secret.Annotations[secretAnnotationSyncIdKey] == "" {
 			return
+		} else if pausedAnnotation(secret) {
+			l.Info("Paused secret deleted, not recreating")
+			return
 		}
 
 		// Recreate the secret as it was deleted
@@ -80,8 +216,8 @@ func deletedSecretHandler(
 		)
 
 		var foundSecret *Secret = nil
-		for _, s := range secrets {
-			if s.DestinationNamespace != secret.Namespace || s.DestinationName != secret.Name {
+		for _, s := range secrets() {
+			if s.reverse() || s.cluster != cluster || s.DestinationNamespace != secret.Namespace || s.DestinationName != secret.Name {
 				continue
 			}
 			foundSecret = s
@@ -92,124 +228,468 @@ func deletedSecretHandler(
 			return
 		}
 
-		// Get the secret from vault
-		vaultSecret, err := vaultClient.Path(
-			foundSecret.Name,
-			vaulty.WithMount(foundSecret.Mount),
-		).GetKvSecretV2(ctx)
+		s, err := syncers()
 		if err != nil {
-			l.Error("Error getting secret from vault", slog.String(loggingKeyError, err.Error()))
+			l.Error("Error recreating secret", slog.String(loggingKeyError, err.Error()))
 			return
 		}
 
-		// Upsert the secret
-		if err := foundSecret.Upsert(ctx, kubeClient, vaultSecret.Data); err != nil { // nolint:revive // Traditional error handling
-			l.Error("Error upserting secret", slog.String(loggingKeyError, err.Error()))
-			return
-		}
+		res, err := s.upsertFromVault(ctx, l, foundSecret)
+		s.status.record(foundSecret, res, err)
+		s.logPlan(l)
 	}
 }
 
 // All secrets will have the annotation of "vault-sync-id=hash" where hash is the hash of the path.
+// Each secret is synced on its own schedule, see schedule.
 func (a *App) syncSecretsTicker(
 	l *slog.Logger,
 ) web.AsyncTaskFunc {
 	return func(ctx context.Context) {
-		ticker := time.NewTicker(a.config.syncInterval)
-		defer ticker.Stop()
+		// The first round schedules every secret within its jitter window.
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+
+		// Only the secrets this replica synced are scheduled. Due secrets synced by other replicas are
+		// checked again one interval later, so a replica that becomes the leader or gains them on the
+		// ring syncs them by then, even if it missed the change notification.
+		syncNow := func(hashBucket cache.HashBucket, secrets []*Secret) {
+			s := a.newSyncer()
+			synced := s.syncSecrets(ctx, l, hashBucket, secrets)
+			s.logPlan(l)
+			a.schedule.synced(l, time.Now(), a.currentConfig(), synced)
+		}
+
+		syncDue := func() {
+			hashBucket := a.hashBucket()
+			due, skipped := make([]*Secret, 0), make([]*Secret, 0)
+			for _, secret := range a.schedule.due(l, time.Now(), a.currentConfig()) {
+				if syncedHere(hashBucket, secret) {
+					due = append(due, secret)
+				} else {
+					skipped = append(skipped, secret)
+				}
+			}
+			a.schedule.skipped(time.Now(), skipped)
+			if len(due) > 0 {
+				l.Debug("Syncing secrets", slog.Int(loggingKeyCount, len(due)))
+				syncNow(hashBucket, due)
+			}
+		}
+
+		// owned tracks the keys this replica owned when it last synced, so that keys gained when the
+		// ring changes can be synced straight away.
+		owned := a.ownedKeys()
 
 		for {
 			select {
 			case <-ctx.Done():
 				l.Info("Stopping secret sync")
 				return
-			case <-ticker.C:
-				l.Debug("Syncing secrets")
-				syncSecrets(
-					ctx,
-					l,
-					a.base.KubeClient(),
-					a.base.VaultClient(),
-					a.base.ServiceEndpointHashBucket(),
-					a.config.Secrets,
-				)
+			case <-a.configChanged:
+				l.Debug("Config changed, rescheduling secrets")
+				syncDue()
+			case <-a.ringChanges():
+				now := a.ownedKeys()
+				gained := make([]*Secret, 0)
+				for _, secret := range a.currentConfig().Secrets {
+					if now.Has(secret.shardKey()) && !owned.Has(secret.shardKey()) {
+						gained = append(gained, secret)
+					}
+				}
+				owned = now
+				if len(gained) == 0 {
+					continue
+				}
+
+				l.Info("Replicas changed, syncing gained secrets", slog.Int(loggingKeyCount, len(gained)))
+				syncNow(a.hashBucket(), gained)
+			case secrets := <-a.syncRequests:
+				syncNow(a.hashBucket(), secrets)
+			case <-a.base.LeaderChange():
+				// Only set in leader election mode. Followers skip every secret until they lead, and a
+				// new leader syncs straight away rather than waiting for the next tick. The change is
+				// not sent while a sync is running, the next round picks the leadership up then.
+				if !a.base.IsLeader() {
+					l.Info("Not the leader, pausing secret sync")
+					continue
+				}
+				l.Info("Became the leader, resuming secret sync")
+				syncNow(a.hashBucket(), a.currentConfig().Secrets)
+			case <-timer.C:
+				owned = a.ownedKeys()
+				syncDue()
 			}
+
+			timer.Reset(a.schedule.wait(time.Now(), a.currentConfig().syncInterval))
 		}
 	}
 }
 
-func syncSecrets(
+// ownedKeys returns the shard keys of the configured secrets owned by this replica.
+func (a *App) ownedKeys() sets.Set[string] {
+	owned := sets.New[string]()
+	for _, secret := range a.currentConfig().Secrets {
+		if owner, _ := a.secretOwner(secret); a.owners.IsLocal(owner) {
+			owned.Insert(secret.shardKey())
+		}
+	}
+	return owned
+}
+
+// syncedHere reports whether the secret is synced by this replica. Every replica writes its own
+// files, they are not sharded.
+func syncedHere(hashBucket cache.HashBucket, secret *Secret) bool {
+	return secret.File != nil || hashBucket.InBucket(secret.shardKey())
+}
+
+// syncSecrets syncs the given secrets that are in the hash bucket, and returns those it synced.
+func (s *syncer) syncSecrets(
 	ctx context.Context,
 	l *slog.Logger,
-	kubeClient kubernetes.Interface,
-	vaultClient vaulty.Client,
 	hashBucket cache.HashBucket,
 	secrets []*Secret,
+) []*Secret {
+	synced := make([]*Secret, 0, len(secrets))
+	byCluster := make(map[string][]*Secret)
+	for _, secret := range secrets {
+		if !syncedHere(hashBucket, secret) {
+			continue
+		}
+
+		synced = append(synced, secret)
+		if secret.File != nil {
+			res, err := s.syncFile(ctx, l, secret)
+			s.status.record(secret, res, err)
+			continue
+		}
+		byCluster[secret.cluster] = append(byCluster[secret.cluster], secret)
+	}
+
+	for _, cluster := range sortedKeys(byCluster) {
+		s.syncCluster(ctx, l, cluster, byCluster[cluster])
+	}
+	return synced
+}
+
+// syncCluster syncs the secrets of a single cluster. If the cluster cannot be reached every one of
+// its secrets fails, without holding up the other clusters.
+func (s *syncer) syncCluster(
+	ctx context.Context,
+	l *slog.Logger,
+	cluster string,
+	secrets []*Secret,
 ) {
-	namespaces, err := kubeClient.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if cluster != "" {
+		l = l.With(slog.String(loggingKeyCluster, cluster))
+	}
+
+	var namespaces []*corev1.Namespace
+	cs, err := s.forCluster(cluster)
+	if err == nil {
+		namespaces, err = cs.namespaceLister.List(labels.Everything())
+	}
 	if err != nil {
 		l.Error("Error listing namespaces", slog.String(loggingKeyError, err.Error()))
+		for _, secret := range secrets {
+			s.status.record(secret, nil, err)
+		}
 		return
 	}
 
 	for _, secret := range secrets {
-		if !hashBucket.InBucket(secret.DestinationName) {
-			continue
+		res, err := cs.syncSecret(ctx, l, namespaces, secret)
+		s.status.record(secret, res, err)
+	}
+}
+
+// syncSecret reconciles a single configured secret, removing copies from other namespaces and
+// upserting the latest value from vault into the destination namespace.
+func (s *syncer) syncSecret(
+	ctx context.Context,
+	l *slog.Logger,
+	namespaces []*corev1.Namespace,
+	secret *Secret,
+) (*syncResult, error) {
+	l = l.With(
+		slog.String(loggingKeyNamespace, secret.DestinationNamespace),
+		slog.String(loggingKeyDestination, secret.DestinationName),
+	)
+
+	if err := secret.Valid(); err != nil {
+		l.Error("Invalid secret", slog.String(loggingKeyError, err.Error()))
+		return nil, fmt.Errorf("invalid secret: %w", err)
+	} else if secret.reverse() {
+		res, err := s.pushToVault(ctx, l, secret)
+		if err != nil {
+			l.Error("Error pushing secret to vault", slog.String(loggingKeyError, err.Error()))
 		}
+		return res, err
+	} else if s.paused(l, secret) {
+		return &syncResult{paused: true}, nil
+	}
 
-		l = l.With(
-			slog.String(loggingKeyNamespace, secret.DestinationNamespace),
-			slog.String(loggingKeyDestination, secret.DestinationName),
-		)
+	others, err := s.namesakes(ctx, secret, namespaces)
+	if err != nil {
+		l.Error("Error getting secrets in other namespaces", slog.String(loggingKeyError, err.Error()))
+		return nil, err
+	}
+
+	for _, foundSecret := range others {
+		l.Info("Secret exists in a different namespace", slog.String(loggingKeyNamespace, foundSecret.Namespace))
 
-		if err := secret.Valid(); err != nil {
-			l.Error("Invalid secret", slog.String(loggingKeyError, err.Error()))
+		reason := "exists outside destination namespace " + secret.DestinationNamespace
+		if s.plan != nil {
+			s.plan.add(&secretChange{
+				Action:    changeActionDelete,
+				Cluster:   secret.cluster,
+				Namespace: foundSecret.Namespace,
+				Name:      foundSecret.Name,
+				Reason:    reason,
+			})
 			continue
 		}
 
-		for i := range namespaces.Items {
-			ns := &namespaces.Items[i]
+		// Delete the secret
+		if err := s.kubeClient.CoreV1().Secrets(foundSecret.Namespace).Delete(ctx, foundSecret.Name, metav1.DeleteOptions{}); err != nil && !coreErr.IsNotFound(err) { // nolint:revive // Traditional error handling
+			l.Error("Error deleting secret", slog.String(loggingKeyError, err.Error()))
+			return nil, fmt.Errorf("error deleting secret from namespace %s: %w", foundSecret.Namespace, err)
+		}
+		auditDeletion(l, foundSecret, reason, secret.ExclusiveName)
+	}
 
-			// Does the secret exist in this namespace?
-			foundSecret, err := kubeClient.CoreV1().Secrets(ns.Name).Get(ctx, secret.DestinationName, metav1.GetOptions{
-				TypeMeta: metav1.TypeMeta{
-					Kind: "Secret",
-				},
-			})
-			if err != nil {
-				newErr := new(coreErr.StatusError)
-				if errors.As(err, &newErr) && newErr.ErrStatus.Reason == metav1.StatusReasonNotFound { // nolint:revive // We need to cast see if the error is a StatusError before we can check the reason
-					// Secret does not exist in this namespace
-					continue
-				}
+	return s.upsertFromVault(ctx, l, secret)
+}
 
-				l.Error("Error getting secret", slog.String(loggingKeyError, err.Error()))
-				continue
-			} else if foundSecret.Namespace != secret.DestinationNamespace { // nolint:revive // We need to check if the secret is in the correct namespace
-				l.Info("Secret exists in a different namespace", slog.String(loggingKeyNamespace, foundSecret.Namespace))
+// namesakes returns the Secrets with the secret's destination name in other namespaces that the
+// secret replaces: those synced from it, or any Secret with exclusive_name. Managed Secrets are read
+// from the lister, but exclusive_name also replaces Secrets that are not managed, so these are
+// listed by name from the API server.
+func (s *syncer) namesakes(ctx context.Context, secret *Secret, namespaces []*corev1.Namespace) ([]*corev1.Secret, error) {
+	found := make([]*corev1.Secret, 0)
+	if secret.ExclusiveName {
+		list, err := s.kubeClient.CoreV1().Secrets(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+			FieldSelector: fields.OneTermEqualSelector("metadata.name", secret.DestinationName).String(),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error listing secrets: %w", err)
+		}
 
-				// Delete the secret
-				if err := kubeClient.CoreV1().Secrets(ns.Name).Delete(ctx, foundSecret.Name, metav1.DeleteOptions{}); err != nil { // nolint:revive // Traditional error handling
-					l.Error("Error deleting secret", slog.String(loggingKeyError, err.Error()))
-					return
-				}
+		for i := range list.Items {
+			if list.Items[i].Namespace != secret.DestinationNamespace {
+				found = append(found, &list.Items[i])
 			}
 		}
+		return found, nil
+	}
 
-		// Get the secret from vault
-		vaultSecret, err := vaultClient.Path(
-			secret.Name,
-			vaulty.WithMount(secret.Mount),
-		).GetKvSecretV2(ctx)
-		if err != nil {
-			l.Error("Error getting secret from vault", slog.String(loggingKeyError, err.Error()))
+	for _, ns := range namespaces {
+		if ns.Name == secret.DestinationNamespace {
 			continue
 		}
 
-		// Upsert the secret
-		if err := secret.Upsert(ctx, kubeClient, vaultSecret.Data); err != nil { // nolint:revive // Traditional error handling
-			l.Error("Error upserting secret", slog.String(loggingKeyError, err.Error()))
+		existing, err := s.secretLister.Secrets(ns.Name).Get(secret.DestinationName)
+		if coreErr.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("error getting secret: %w", err)
+		} else if secret.syncedFrom(existing) {
+			found = append(found, existing)
+		}
+	}
+	return found, nil
+}
+
+// upsertFromVault reads the secret from vault and upserts it into the destination namespace, or
+// plans the upsert when running dry. Nothing is written while the destination is paused.
+func (s *syncer) upsertFromVault(ctx context.Context, l *slog.Logger, secret *Secret) (*syncResult, error) {
+	if s.paused(l, secret) {
+		return &syncResult{paused: true}, nil
+	} else if err := s.checkPolicies(ctx, l, secret); err != nil {
+		return nil, err
+	}
+
+	pin, err := s.pinnedVersion(secret)
+	if err != nil {
+		l.Error("Error reading pin", slog.String(loggingKeyError, err.Error()))
+		return nil, err
+	}
+	s.logPin(l, secret, pin)
+	recordPin(secret, pin)
+
+	// Get the secret from vault
+	var vaultSecret *hashiVault.KVSecret
+	if pin > 0 {
+		vaultSecret, err = s.readVersion(ctx, secret, pin)
+	} else {
+		vaultSecret, err = s.readFromVault(ctx, secret)
+		if errors.Is(err, ErrSourceDeleted) {
+			vaultSecret, err = s.sourceDeleted(ctx, l, secret, err)
+		}
+	}
+	if err != nil {
+		l.Error("Error getting secret from vault", slog.String(loggingKeyError, err.Error()))
+		return nil, fmt.Errorf("error getting secret from vault: %w", err)
+	}
+
+	if secret.Immutable {
+		res, err := s.upsertVersioned(ctx, l, secret, vaultSecret)
+		if err != nil {
+			l.Error("Error upserting versioned secret", slog.String(loggingKeyError, err.Error()))
+			return nil, fmt.Errorf("error upserting versioned secret: %w", err)
+		}
+		return res, nil
+	}
+
+	if s.plan != nil {
+		change, err := secret.Diff(ctx, s.kubeClient, s.secretLister, s.hasher, vaultSecret.Data)
+		if err != nil {
+			l.Error("Error diffing secret", slog.String(loggingKeyError, err.Error()))
+			return nil, fmt.Errorf("error diffing secret: %w", err)
+		}
+		s.plan.add(change)
+		if change.Action == changeActionConflict {
+			return nil, fmt.Errorf("secret %s/%s is not managed by %s", secret.DestinationNamespace, secret.DestinationName, appName)
+		}
+		return &syncResult{
+			vaultVersion: vaultVersion(vaultSecret),
+			hash:         change.hash,
+		}, nil
+	}
+
+	// Upsert the secret
+	upserted, err := secret.Upsert(ctx, s.kubeClient, s.secretLister, s.hasher, vaultSecret.Data)
+	if err != nil {
+		l.Error("Error upserting secret", slog.String(loggingKeyError, err.Error()))
+		return nil, fmt.Errorf("error upserting secret: %w", err)
+	}
+
+	if upserted.changed {
+		s.reload.Notify(ctx, secret.DestinationNamespace, secret.DestinationName)
+	} else if upserted.migrated {
+		l.Info("Sync annotation migrated to the current hash algorithm")
+	}
+
+	return &syncResult{
+		vaultVersion: vaultVersion(vaultSecret),
+		hash:         upserted.hash,
+	}, nil
+}
+
+// removeSecret deletes the destination of a secret, if it was synced from it by secret-sync.
+func (s *syncer) removeSecret(ctx context.Context, l *slog.Logger, secret *Secret, reason string) {
+	if secret.File != nil {
+		s.removeFile(l, secret, reason)
+		return
+	}
+
+	l = l.With(
+		slog.String(loggingKeyNamespace, secret.DestinationNamespace),
+		slog.String(loggingKeyDestination, secret.DestinationName),
+	)
+
+	existing, err := s.secretLister.Secrets(secret.DestinationNamespace).Get(secret.DestinationName)
+	switch {
+	case coreErr.IsNotFound(err):
+		existing = nil
+	case err != nil:
+		l.Error("Error getting secret to remove", slog.String(loggingKeyError, err.Error()))
+		return
+	case !secret.syncedFrom(existing):
+		existing = nil
+	case pausedAnnotation(existing):
+		l.Warn("Secret paused, not removing", slog.String(loggingKeyReason, reason))
+		return
+	}
+
+	// The versions of an immutable secret are removed along with its pointer.
+	if secret.Immutable {
+		s.removeVersions(ctx, l, secret, reason)
+	}
+	if existing == nil {
+		return
+	}
+
+	if s.plan != nil {
+		s.plan.add(&secretChange{
+			Action:    changeActionDelete,
+			Cluster:   secret.cluster,
+			Namespace: secret.DestinationNamespace,
+			Name:      secret.DestinationName,
+			Reason:    reason,
+		})
+		return
+	}
+
+	if err := s.kubeClient.CoreV1().Secrets(secret.DestinationNamespace).Delete(ctx, secret.DestinationName, metav1.DeleteOptions{}); err != nil && !coreErr.IsNotFound(err) {
+		l.Error("Error removing secret", slog.String(loggingKeyError, err.Error()))
+		return
+	}
+	auditDeletion(l, existing, reason, false)
+}
+
+// auditDeletion records that secret-sync deleted a Kubernetes Secret.
+func auditDeletion(l *slog.Logger, deleted *corev1.Secret, reason string, exclusive bool) {
+	l.Warn("Audit: secret deleted",
+		slog.String(loggingKeyNamespace, deleted.Namespace),
+		slog.String(loggingKeyDestination, deleted.Name),
+		slog.String(loggingKeyReason, reason),
+		slog.Bool(loggingKeyExclusive, exclusive),
+	)
+}
+
+// logPlan logs the changes collected by a dry run.
+func (s *syncer) logPlan(l *slog.Logger) {
+	if s.plan == nil {
+		return
+	}
+
+	for _, change := range s.plan.changes() {
+		if change.Action == changeActionUnchanged {
 			continue
 		}
+		if change.Path != "" {
+			l.Info("Dry run, change not applied",
+				slog.String(loggingKeyAction, string(change.Action)),
+				slog.String(loggingKeyPath, change.Path),
+				slog.String(loggingKeyChange, change.summary()),
+			)
+			continue
+		}
+
+		l.Info("Dry run, change not applied",
+			slog.String(loggingKeyAction, string(change.Action)),
+			slog.String(loggingKeyCluster, clusterDisplayName(change.Cluster)),
+			slog.String(loggingKeyNamespace, change.Namespace),
+			slog.String(loggingKeyDestination, change.Name),
+			slog.String(loggingKeyChange, change.summary()),
+		)
+	}
+}
+
+// reconcileNow runs an immediate sync of a single secret, bypassing the ticker.
+func (a *App) reconcileNow(ctx context.Context, l *slog.Logger, secret *Secret) error {
+	if secret.File != nil {
+		s := a.newSyncer()
+		res, err := s.syncFile(ctx, l, secret)
+		s.status.record(secret, res, err)
+		s.logPlan(l)
+		return err
 	}
+
+	s, err := a.newSyncer().forCluster(secret.cluster)
+	if err != nil {
+		a.status.record(secret, nil, err)
+		return err
+	}
+
+	namespaces, err := s.namespaceLister.List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("error listing namespaces: %w", err)
+	}
+
+	res, err := s.syncSecret(ctx, l, namespaces, secret)
+	s.status.record(secret, res, err)
+	s.logPlan(l)
+	return err
 }
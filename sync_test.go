@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// BenchmarkSyncSecrets syncs secrets that are up to date on a cluster with many namespaces, and
+// reports the reads that reach the API server. Every read is served by the informers.
+func BenchmarkSyncSecrets(b *testing.B) {
+	const (
+		namespaceCount = 500
+		secretCount    = 20
+	)
+
+	ctx := b.Context()
+	l := slog.New(slog.DiscardHandler)
+	vault := newFakeVault(b)
+
+	objects := make([]runtime.Object, 0, 2*namespaceCount)
+	for i := range namespaceCount {
+		namespace := fmt.Sprintf("ns-%d", i)
+		objects = append(objects,
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}},
+			// Secrets that are not managed are not read.
+			&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "unmanaged"}},
+		)
+	}
+	kubeClient := fake.NewClientset(objects...)
+
+	secrets := make([]*Secret, 0, secretCount)
+	for i := range secretCount {
+		secret := &Secret{
+			Mount:                "secret",
+			Name:                 fmt.Sprintf("app-%d", i),
+			DestinationNamespace: fmt.Sprintf("ns-%d", i),
+			DestinationName:      fmt.Sprintf("app-%d", i),
+		}
+		vault.put(secret.Mount, secret.Name, map[string]any{"password": secret.Name})
+		secrets = append(secrets, secret)
+	}
+
+	factory := newInformers(kubeClient)
+	factory.Start(ctx.Done())
+	for informerType, synced := range factory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			b.Fatalf("failed to sync %s informer cache", informerType)
+		}
+	}
+
+	s := &syncer{
+		kubeClient:      kubeClient,
+		vaults:          newVaultClients(ctx, l, map[string]*vaultConfig{"": vault.config(b)}),
+		hasher:          newContentHasher(nil, 1),
+		status:          newStatusStore(),
+		secretLister:    factory.Core().V1().Secrets().Lister(),
+		namespaceLister: factory.Core().V1().Namespaces().Lister(),
+		sources:         newSourceInformers(kubeClient),
+	}
+
+	// The first sync creates every secret, wait for the informer to see them.
+	s.syncSecrets(ctx, l, allBucket{}, secrets)
+	for _, secret := range secrets {
+		if st, _ := s.status.get(secret); st.LastError != "" {
+			b.Fatalf("syncing %s: %s", secret.DestinationName, st.LastError)
+		}
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		managed, err := s.secretLister.List(managedSelector)
+		if err != nil {
+			b.Fatalf("listing managed secrets: %v", err)
+		} else if len(managed) == secretCount {
+			break
+		} else if time.Now().After(deadline) {
+			b.Fatalf("informer holds %d managed secrets, want %d", len(managed), secretCount)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	kubeClient.ClearActions()
+
+	for b.Loop() {
+		s.syncSecrets(ctx, l, allBucket{}, secrets)
+	}
+
+	reads := 0
+	for _, action := range kubeClient.Actions() {
+		if action.GetVerb() == "get" || action.GetVerb() == "list" {
+			reads++
+		}
+	}
+	b.ReportMetric(float64(reads)/float64(b.N), "reads/op")
+	if reads > 0 {
+		b.Errorf("syncs read from the API server %d times, want every read served by the informers", reads)
+	}
+}
+
+func TestDeletedSecretHandlerSkipsVersions(t *testing.T) {
+	l := slog.New(slog.DiscardHandler)
+	configured := &Secret{Mount: "secret", Name: "app", DestinationNamespace: "default", DestinationName: "app", Immutable: true}
+
+	tests := []struct {
+		name   string
+		secret *corev1.Secret
+		want   bool
+	}{
+		{
+			name: "pointer",
+			secret: &corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+				Name:        "app",
+				Namespace:   "default",
+				Labels:      map[string]string{secretLabelManagedBy: appName},
+				Annotations: map[string]string{secretAnnotationSyncIdKey: "hash"},
+			}},
+			want: true,
+		},
+		{
+			name: "pruned version",
+			secret: &corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+				Name:      "app-v1",
+				Namespace: "default",
+				Labels: map[string]string{
+					secretLabelManagedBy:   appName,
+					secretLabelDestination: "app",
+					secretLabelVersion:     "1",
+				},
+				Annotations: map[string]string{secretAnnotationSyncIdKey: "hash"},
+			}},
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			synced := false
+			syncers := func() (*syncer, error) {
+				synced = true
+				return nil, errors.New("not syncing in tests")
+			}
+
+			handler := deletedSecretHandler(t.Context(), l, syncers, "", allBucket{}, func() []*Secret {
+				return []*Secret{configured}
+			})
+			handler(tt.secret)
+
+			if synced != tt.want {
+				t.Errorf("deleting %s synced = %t, want %t", tt.secret.Name, synced, tt.want)
+			}
+		})
+	}
+}
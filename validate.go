@@ -0,0 +1,296 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/go-viper/mapstructure/v2"
+	"github.com/jacobbrewer1/web"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// knownConfigKeys are the top level configuration keys.
+var knownConfigKeys = sets.New(
+	"secrets",
+	"refresh_interval",
+	"refresh_jitter",
+	"dry_run",
+	"reload",
+	"vault",
+	"vaults",
+	"policies",
+	"hashing",
+	"kubernetes",
+	"clusters",
+	"coordination_mode",
+	"vault_events",
+	"api",
+)
+
+// knownCoordinationModes are the supported values of coordination_mode.
+var knownCoordinationModes = sets.New(
+	coordinationModeHashBucket,
+	coordinationModeLeaderElection,
+	coordinationModeNone,
+)
+
+// knownReloadKeys are the keys of the reload configuration.
+var knownReloadKeys = sets.New(
+	"debounce",
+	"min_interval",
+)
+
+// Validate checks the configuration file without connecting to vault or Kubernetes and writes
+// every problem found to w. It reports false if the configuration is invalid.
+func (a *App) Validate(w io.Writer) (bool, error) {
+	if err := a.base.Start(
+		web.WithMetricsEnabled(false),
+		web.WithViperConfig(),
+	); err != nil {
+		return false, fmt.Errorf("failed to start web app: %w", err)
+	}
+
+	problems := validateConfig(a.base.Viper())
+	for _, problem := range problems {
+		fmt.Fprintln(w, problem.Error())
+	}
+
+	if len(problems) == 0 {
+		fmt.Fprintln(w, "configuration is valid")
+		return true, nil
+	}
+
+	fmt.Fprintf(w, "\n%d problems found\n", len(problems))
+	return false, nil
+}
+
+// validateConfig returns every problem with the configuration.
+func validateConfig(vip *viper.Viper) []error {
+	problems := make([]error, 0)
+	problems = append(problems, unknownKeys("", vip.AllSettings(), knownConfigKeys)...)
+
+	if _, err := parseRefreshInterval(vip); err != nil {
+		problems = append(problems, err)
+	}
+
+	if _, err := parseRefreshJitter(vip); err != nil {
+		problems = append(problems, err)
+	}
+
+	if mode := vip.GetString("coordination_mode"); mode != "" && !knownCoordinationModes.Has(mode) {
+		problems = append(problems, fmt.Errorf("coordination_mode: %w: %q", ErrUnknownCoordinationMode, mode))
+	}
+
+	if reload, ok := vip.Get("reload").(map[string]any); ok {
+		problems = append(problems, unknownKeys("reload.", reload, knownReloadKeys)...)
+		for _, key := range sets.List(knownReloadKeys) {
+			if !vip.IsSet("reload." + key) {
+				continue
+			} else if _, err := time.ParseDuration(vip.GetString("reload." + key)); err != nil {
+				problems = append(problems, fmt.Errorf("reload.%s: %w", key, err))
+			}
+		}
+	}
+
+	if hashing, ok := vip.Get("hashing").(map[string]any); ok {
+		problems = append(problems, unknownKeys("hashing.", hashing, knownHashingKeys)...)
+	}
+
+	if api, ok := vip.Get("api").(map[string]any); ok {
+		problems = append(problems, unknownKeys("api.", api, knownAPIKeys)...)
+	}
+
+	if kube, ok := vip.Get("kubernetes").(map[string]any); ok {
+		problems = append(problems, unknownKeys("kubernetes.", kube, knownKubernetesKeys)...)
+	}
+
+	vaults, err := decodeVaults(vip)
+	if err != nil {
+		problems = append(problems, err)
+	}
+	problems = append(problems, validateVaults(vaults)...)
+
+	policies, err := decodePolicies(vip)
+	if err != nil {
+		problems = append(problems, err)
+	}
+	problems = append(problems, validatePolicies(policies)...)
+
+	clusters, err := decodeClusters(vip)
+	if err != nil {
+		problems = append(problems, err)
+	}
+	problems = append(problems, validateClusters(clusters)...)
+	problems = append(problems, validateClusterVaultRefs(clusters, vaults)...)
+
+	secrets, errs := decodeSecrets(vip.Get("secrets"))
+	problems = append(problems, errs...)
+	problems = append(problems, validateSecrets(secrets, clusters)...)
+	problems = append(problems, validateVaultRefs(secrets, vaults)...)
+	problems = append(problems, validateClusterRefs(secrets, clusters)...)
+	problems = append(problems, validateVaultWriters(secrets, clusters)...)
+	problems = append(problems, validateSecretPolicies(secrets, policies)...)
+	return problems
+}
+
+// decodeSecrets strictly decodes the raw secrets configuration, rejecting unknown fields. Entries
+// that fail to decode are reported and left nil, so that the result lines up with the config.
+func decodeSecrets(raw any) ([]*Secret, []error) {
+	errs := make([]error, 0)
+
+	entries, ok := raw.([]any)
+	if !ok {
+		errs = append(errs, errors.New("secrets: expected a list of secrets"))
+		return make([]*Secret, 0), errs
+	} else if len(entries) == 0 {
+		errs = append(errs, errors.New("secrets: no secrets provided"))
+		return make([]*Secret, 0), errs
+	}
+
+	secrets := make([]*Secret, len(entries))
+	for i, entry := range entries {
+		secret, decodeErrs := decodeSecret(entry)
+		for _, err := range decodeErrs {
+			errs = append(errs, fmt.Errorf("secrets[%d]: %w", i, err))
+		}
+		secrets[i] = secret
+	}
+
+	return secrets, errs
+}
+
+// decodeSecret decodes a single secret entry with decodeStrict. Secrets are always decoded with it,
+// so that the application and validate accept the same entries. It returns every problem with the
+// entry, and a nil secret if there are any.
+func decodeSecret(entry any) (*Secret, []error) {
+	secret := new(Secret)
+	if errs := decodeStrict(entry, secret); len(errs) > 0 {
+		return nil, errs
+	}
+	return secret, nil
+}
+
+// decodeStrict decodes a raw config value into result, with the hooks viper decodes the rest of the
+// config with, rejecting unknown fields. It returns every problem with the value.
+func decodeStrict(raw, result any) []error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+		),
+		WeaklyTypedInput: true,
+		ErrorUnused:      true,
+		Result:           result,
+	})
+	if err != nil {
+		return []error{fmt.Errorf("error creating decoder: %w", err)}
+	}
+
+	err = decoder.Decode(raw)
+	if err == nil {
+		return nil
+	}
+
+	// Several problems are reported together, split them so that each is reported on its own.
+	var joined interface{ Unwrap() []error }
+	if errors.As(err, &joined) {
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
+
+// validateSecrets returns every problem with the configured secrets, including destinations that
+// are configured more than once in the same cluster, and files written by more than one secret.
+func validateSecrets(secrets []*Secret, clusters map[string]*clusterConfig) []error {
+	names := clusterNames(clusters)
+
+	errs := make([]error, 0)
+	seen := make(map[string]int)
+	for i, secret := range secrets {
+		if secret == nil {
+			continue
+		}
+
+		if err := secret.Valid(); err != nil {
+			for _, e := range unjoin(err) {
+				errs = append(errs, fmt.Errorf("secrets[%d]: %w", i, e))
+			}
+		}
+
+		keys := make([]string, 0)
+		switch {
+		case secret.File != nil:
+			if secret.File.Path != "" {
+				keys = append(keys, fileKey(secret.File.Path))
+			}
+		case secret.DestinationNamespace != "" && secret.DestinationName != "":
+			for _, cluster := range secret.targetClusters(names) {
+				keys = append(keys, targetKey(cluster, secret.DestinationNamespace, secret.DestinationName))
+			}
+		}
+
+		for _, key := range keys {
+			if first, ok := seen[key]; ok {
+				errs = append(errs, fmt.Errorf("secrets[%d]: %w: %s is also configured by secrets[%d]", i, ErrDuplicateDestination, key, first))
+				continue
+			}
+			seen[key] = i
+		}
+	}
+	return errs
+}
+
+// parseRefreshInterval returns the configured interval between syncs.
+func parseRefreshInterval(vip *viper.Viper) (time.Duration, error) {
+	interval, err := time.ParseDuration(vip.GetString("refresh_interval"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse refresh interval: %w", err)
+	} else if interval <= 0 {
+		return 0, errors.New("invalid refresh interval")
+	}
+	return interval, nil
+}
+
+// parseRefreshJitter returns the configured fraction of the refresh interval added at random to
+// each sync.
+func parseRefreshJitter(vip *viper.Viper) (float64, error) {
+	vip.SetDefault("refresh_jitter", defaultRefreshJitter)
+
+	jitter, err := cast.ToFloat64E(vip.Get("refresh_jitter"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse refresh jitter: %w", err)
+	} else if jitter < 0 || jitter > 1 {
+		return 0, errors.New("refresh jitter must be between 0 and 1")
+	}
+	return jitter, nil
+}
+
+// unknownKeys returns an error for every key in settings that is not known.
+func unknownKeys(prefix string, settings map[string]any, known sets.Set[string]) []error {
+	keys := make([]string, 0)
+	for key := range settings {
+		if !known.Has(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	errs := make([]error, 0, len(keys))
+	for _, key := range keys {
+		errs = append(errs, fmt.Errorf("unknown field %q", prefix+key))
+	}
+	return errs
+}
+
+// unjoin splits an error created by errors.Join into its parts.
+func unjoin(err error) []error {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok { // nolint:errorlint // Only the top level join is split
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestParseConfigRejectsUnknownFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{
+			name: "vault",
+			config: `
+vaults:
+  other:
+    address: http://vault:8200
+    auth_methd: token
+`,
+			want: "invalid keys: auth_methd",
+		},
+		{
+			name: "cluster",
+			config: `
+clusters:
+  remote:
+    kubeconfig_secret: default/remote
+    contxt: remote
+`,
+			want: "invalid keys: contxt",
+		},
+		{
+			name: "policy",
+			config: `
+policies:
+  - name: deny-prod
+    effect: deny
+    paths: ["prod/*"]
+    namespace: ["default"]
+`,
+			want: "invalid keys: namespace",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vip := viper.New()
+			vip.SetConfigType("yaml")
+			config := tt.config + `
+secrets:
+  - mount: secret
+    name: app
+    destination_namespace: default
+    destination_name: app
+`
+			if err := vip.ReadConfig(strings.NewReader(config)); err != nil {
+				t.Fatalf("reading config: %v", err)
+			}
+
+			_, err := parseConfig(vip)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("parseConfig() error = %v, want the unknown field %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,696 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	hashiVault "github.com/hashicorp/vault/api"
+	kubernetesAuth "github.com/hashicorp/vault/api/auth/kubernetes"
+	"github.com/jacobbrewer1/vaulty"
+	"github.com/jacobbrewer1/web/health"
+	"github.com/jacobbrewer1/web/k8s"
+	"github.com/jacobbrewer1/web/logging"
+	"github.com/spf13/viper"
+)
+
+const (
+	// vaultAuthKubernetes logs in with the pod's service account token.
+	vaultAuthKubernetes = "kubernetes"
+
+	// vaultAuthToken uses a token read from a file.
+	vaultAuthToken = "token"
+
+	// vaultAuthAppRole logs in with a role ID and a secret ID read from a file.
+	vaultAuthAppRole = "approle"
+
+	// defaultVaultName is the name the vault configured under vault.address is reported as.
+	defaultVaultName = "default"
+
+	// defaultVaultAddress is the address of the default vault when vault.address is not set.
+	defaultVaultAddress = "http://vault-active.vault:8200"
+
+	// namespaceRolePlaceholder is replaced by the destination namespace in namespace_role.
+	namespaceRolePlaceholder = "{namespace}"
+
+	// vaultRetryInterval is the minimum time between two failed logins with the same client.
+	vaultRetryInterval = 30 * time.Second
+
+	// serviceAccountTokenPath is where the pod's service account token is mounted.
+	serviceAccountTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token" // nolint:gosec // This is not a credential
+)
+
+var (
+	ErrUnknownVault         = errors.New("unknown vault")
+	ErrUnknownVaultAuth     = errors.New("unknown vault auth method")
+	ErrInvalidVaultAddress  = errors.New("vault address is required")
+	ErrMissingVaultAuthInfo = errors.New("missing vault auth info")
+	ErrInvalidNamespaceRole = errors.New("invalid namespace role")
+)
+
+// vaultConfig is a named vault cluster from the vaults config, and how to authenticate to it.
+type vaultConfig struct {
+	Address string `mapstructure:"address"`
+
+	// AuthMethod is kubernetes (default), token or approle.
+	AuthMethod string `mapstructure:"auth_method"`
+
+	// Role is the kubernetes auth role, the service account name by default.
+	Role string `mapstructure:"role"`
+
+	// TokenFile holds the token for token auth.
+	TokenFile string `mapstructure:"token_file"`
+
+	// RoleID and SecretIDFile are the AppRole credentials.
+	RoleID       string `mapstructure:"role_id"`
+	SecretIDFile string `mapstructure:"secret_id_file"`
+
+	// Namespace is the vault enterprise namespace to log in and read secrets in.
+	Namespace string `mapstructure:"namespace"`
+
+	// CACert is the path to the PEM encoded CA certificate the vault server is verified with.
+	CACert string `mapstructure:"ca_cert"`
+
+	// NamespaceRole, when set, logs in with kubernetes auth as a role per destination namespace. The
+	// {namespace} placeholder is replaced with the secret's destination namespace.
+	NamespaceRole string `mapstructure:"namespace_role"`
+}
+
+// authMethod returns the configured auth method.
+func (c *vaultConfig) authMethod() string {
+	if c.AuthMethod == "" {
+		return vaultAuthKubernetes
+	}
+	return c.AuthMethod
+}
+
+// Valid returns every problem with the vault config.
+func (c *vaultConfig) Valid() error {
+	errs := make([]error, 0)
+	if c.Address == "" {
+		errs = append(errs, ErrInvalidVaultAddress)
+	}
+
+	switch c.authMethod() {
+	case vaultAuthKubernetes:
+	case vaultAuthToken:
+		if c.TokenFile == "" {
+			errs = append(errs, fmt.Errorf("%w: token_file is required", ErrMissingVaultAuthInfo))
+		}
+	case vaultAuthAppRole:
+		if c.RoleID == "" || c.SecretIDFile == "" {
+			errs = append(errs, fmt.Errorf("%w: role_id and secret_id_file are required", ErrMissingVaultAuthInfo))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("%w: %q", ErrUnknownVaultAuth, c.AuthMethod))
+	}
+
+	if c.NamespaceRole != "" {
+		if c.authMethod() != vaultAuthKubernetes {
+			errs = append(errs, fmt.Errorf("%w: namespace_role needs kubernetes auth", ErrInvalidNamespaceRole))
+		} else if !strings.Contains(c.NamespaceRole, namespaceRolePlaceholder) {
+			errs = append(errs, fmt.Errorf("%w: %q does not contain %s", ErrInvalidNamespaceRole, c.NamespaceRole, namespaceRolePlaceholder))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// namespaceRole returns the kubernetes auth role for secrets synced into the given namespace, or
+// the empty string if the vault does not log in with a role per namespace.
+func (c *vaultConfig) namespaceRole(namespace string) string {
+	if c.NamespaceRole == "" {
+		return ""
+	}
+	return strings.ReplaceAll(c.NamespaceRole, namespaceRolePlaceholder, namespace)
+}
+
+// authOption returns the vaulty option that logs in with the configured auth method.
+func (c *vaultConfig) authOption() (vaulty.ClientOption, error) {
+	switch c.authMethod() {
+	case vaultAuthToken:
+		token, err := readCredential(c.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		return vaulty.WithTokenAuth(token), nil
+	case vaultAuthAppRole:
+		secretID, err := readCredential(c.SecretIDFile)
+		if err != nil {
+			return nil, err
+		}
+		return vaulty.WithAppRoleAuth(c.RoleID, secretID), nil
+	case vaultAuthKubernetes:
+		role := c.Role
+		if role == "" {
+			role = k8s.ServiceAccountName()
+		}
+		return vaulty.WithKubernetesServiceAccountAuth(role), nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownVaultAuth, c.AuthMethod)
+	}
+}
+
+// hashiConfig returns the vault API config for the cluster.
+func (c *vaultConfig) hashiConfig() (*hashiVault.Config, error) {
+	cfg := hashiVault.DefaultConfig()
+	if cfg.Error != nil {
+		return nil, fmt.Errorf("error creating vault config: %w", cfg.Error)
+	}
+	cfg.Address = c.Address
+
+	if c.CACert != "" {
+		if err := cfg.ConfigureTLS(&hashiVault.TLSConfig{CACert: c.CACert}); err != nil {
+			return nil, fmt.Errorf("error configuring vault TLS: %w", err)
+		}
+	}
+
+	if c.Namespace != "" {
+		cfg.HttpClient.Transport = &namespaceTransport{
+			namespace: c.Namespace,
+			base:      cfg.HttpClient.Transport,
+		}
+	}
+	return cfg, nil
+}
+
+// readCredential reads a credential from a mounted file.
+func readCredential(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading credential: %w", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// namespaceTransport sets the vault namespace on every request that does not set its own, so that
+// the client logs in, renews its token and reads secrets in the namespace.
+type namespaceTransport struct {
+	namespace string
+	base      http.RoundTripper
+}
+
+func (t *namespaceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get(hashiVault.NamespaceHeaderName) == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set(hashiVault.NamespaceHeaderName, t.namespace)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// vaultTLSConfig returns the TLS config the vault client verifies the server with, if any.
+func vaultTLSConfig(client *hashiVault.Client) *tls.Config {
+	httpClient := client.CloneConfig().HttpClient
+	if httpClient == nil {
+		return nil
+	}
+
+	transport := httpClient.Transport
+	if ns, ok := transport.(*namespaceTransport); ok {
+		transport = ns.base
+	}
+	if t, ok := transport.(*http.Transport); ok && t.TLSClientConfig != nil {
+		return t.TLSClientConfig.Clone()
+	}
+	return nil
+}
+
+// vaultNamespace returns the namespace the vault client reads secrets in.
+func vaultNamespace(client *hashiVault.Client) string {
+	if ns := client.Namespace(); ns != "" {
+		return ns
+	}
+	if httpClient := client.CloneConfig().HttpClient; httpClient != nil {
+		if t, ok := httpClient.Transport.(*namespaceTransport); ok {
+			return t.namespace
+		}
+	}
+	return ""
+}
+
+// vaultClientKey identifies a vault client by the vault it reads from and, when logging in with a
+// role per destination namespace, the role. A non-empty namespace overrides the vault's namespace.
+type vaultClientKey struct {
+	vault     string
+	role      string
+	namespace string
+}
+
+// vaultClients holds the clients for every configured vault. The default vault's client is created
+// at startup, the others are created the first time a secret reads from them.
+type vaultClients struct {
+	mut *sync.Mutex
+
+	// ctx outlives every client, it stops their token renewals.
+	ctx context.Context
+	l   *slog.Logger
+
+	configs map[string]*vaultConfig
+	clients map[vaultClientKey]vaulty.Client
+
+	// cancels stop the token renewal of each client created here.
+	cancels map[vaultClientKey]context.CancelFunc
+
+	// attempts holds when each client last logged in, and pending is closed when the login ends.
+	attempts map[vaultClientKey]time.Time
+	pending  map[vaultClientKey]chan struct{}
+
+	// errs holds the last error creating each client. A failed login is retried at most once per
+	// vaultRetryInterval, until then the error is returned. Role clients are left out of the vault's
+	// health check, a role that cannot log in only fails the secrets read with it.
+	errs map[vaultClientKey]error
+
+	// tokenPath is the service account token role clients log in with. It is read on every login, so
+	// that the rotated projected token is used.
+	tokenPath string
+}
+
+func newVaultClients(ctx context.Context, l *slog.Logger, configs map[string]*vaultConfig) *vaultClients {
+	return &vaultClients{
+		mut:      new(sync.Mutex),
+		ctx:      ctx,
+		l:        l,
+		configs:  configs,
+		clients:  make(map[vaultClientKey]vaulty.Client),
+		cancels:  make(map[vaultClientKey]context.CancelFunc),
+		attempts: make(map[vaultClientKey]time.Time),
+		pending:  make(map[vaultClientKey]chan struct{}),
+		errs:     make(map[vaultClientKey]error),
+
+		tokenPath: serviceAccountTokenPath,
+	}
+}
+
+// client returns the client for the named vault, creating it if needed. The empty name is the
+// default vault.
+func (v *vaultClients) client(name string) (vaulty.Client, error) {
+	return v.get(vaultClientKey{vault: name})
+}
+
+// forSecret returns the client the secret is read with. If the vault logs in with a role per
+// destination namespace, this is the client for the role of the secret's destination namespace. If
+// the secret sets its own vault namespace, the client logs in and reads in that namespace.
+func (v *vaultClients) forSecret(secret *Secret) (vaulty.Client, error) {
+	v.mut.Lock()
+	cfg, ok := v.configs[secret.Vault]
+	v.mut.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownVault, secret.Vault)
+	}
+
+	return v.get(vaultClientKey{
+		vault:     secret.Vault,
+		role:      cfg.namespaceRole(secret.DestinationNamespace),
+		namespace: secret.VaultNamespace,
+	})
+}
+
+func (v *vaultClients) get(key vaultClientKey) (vaulty.Client, error) {
+	v.mut.Lock()
+	for {
+		if client, ok := v.clients[key]; ok {
+			v.mut.Unlock()
+			return client, nil
+		}
+
+		// Another read is already logging in with the key, wait for it rather than logging in twice.
+		done, ok := v.pending[key]
+		if !ok {
+			break
+		}
+		v.mut.Unlock()
+		<-done
+		v.mut.Lock()
+	}
+
+	vaultCfg, ok := v.configs[key.vault]
+	if !ok {
+		v.mut.Unlock()
+		return nil, fmt.Errorf("%w: %q", ErrUnknownVault, key.vault)
+	} else if err := v.errs[key]; err != nil && time.Since(v.attempts[key]) < vaultRetryInterval {
+		v.mut.Unlock()
+		return nil, fmt.Errorf("error creating client for vault %q: %w", vaultDisplayName(key.vault), err)
+	}
+
+	done := make(chan struct{})
+	v.pending[key] = done
+	v.attempts[key] = time.Now()
+	base := *vaultCfg
+	v.mut.Unlock()
+	defer close(done)
+
+	cfg := base
+	ctx, cancel := context.WithCancel(v.ctx)
+	l := v.l.With(slog.String(loggingKeyVault, vaultDisplayName(key.vault)))
+	if key.role != "" {
+		l = l.With(slog.String(loggingKeyRole, key.role))
+	}
+	if key.namespace != "" {
+		cfg.Namespace = key.namespace
+		l = l.With(slog.String(loggingKeyVaultNamespace, key.namespace))
+	}
+
+	// The login is a network call, it is made without the lock so that a slow vault or role does not
+	// hold up reads with other clients or the health checks.
+	var (
+		client   vaulty.Client
+		authInfo *hashiVault.Secret
+		err      error
+	)
+	if key.role != "" {
+		client, authInfo, err = newRoleClient(ctx, l, &cfg, key.role, v.tokenPath)
+	} else {
+		client, err = newVaultClient(ctx, l, &cfg)
+	}
+
+	v.mut.Lock()
+	defer v.mut.Unlock()
+	delete(v.pending, key)
+
+	if current, ok := v.configs[key.vault]; !ok || *current != base {
+		// The vault was changed or removed by a config reload while logging in.
+		cancel()
+		return nil, fmt.Errorf("error creating client for vault %q: config changed while logging in", vaultDisplayName(key.vault))
+	} else if err != nil {
+		cancel()
+		v.errs[key] = err
+		return nil, fmt.Errorf("error creating client for vault %q: %w", vaultDisplayName(key.vault), err)
+	}
+
+	delete(v.errs, key)
+	v.clients[key] = client
+	v.cancels[key] = cancel
+	if authInfo != nil {
+		go v.renewRoleToken(ctx, l, key, client, authInfo)
+	}
+	l.Info("Vault client created")
+	return client, nil
+}
+
+// renewRoleToken renews the token of a role client until it can no longer be renewed, then closes
+// the client. The next secret read with the role logs in again, so a failed login only fails the
+// secrets read with that role.
+func (v *vaultClients) renewRoleToken(
+	ctx context.Context,
+	l *slog.Logger,
+	key vaultClientKey,
+	client vaulty.Client,
+	authInfo *hashiVault.Secret,
+) {
+	defer v.close(key, client)
+
+	watcher, err := client.Client().NewLifetimeWatcher(&hashiVault.LifetimeWatcherInput{
+		Secret: authInfo,
+	})
+	if err != nil {
+		l.Error("Error watching vault token", slog.String(loggingKeyError, err.Error()))
+		return
+	}
+
+	go watcher.Start()
+	defer watcher.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-watcher.RenewCh():
+			l.Debug("Vault token renewed")
+		case err := <-watcher.DoneCh():
+			if err != nil {
+				l.Warn("Error renewing vault token, logging in again on next use", slog.String(loggingKeyError, err.Error()))
+			} else {
+				l.Info("Vault token can no longer be renewed, logging in again on next use")
+			}
+			return
+		}
+	}
+}
+
+// close closes the client, unless it has already been replaced.
+func (v *vaultClients) close(key vaultClientKey, client vaulty.Client) {
+	v.mut.Lock()
+	defer v.mut.Unlock()
+
+	if current, ok := v.clients[key]; !ok || current != client {
+		return
+	}
+
+	v.cancels[key]()
+	delete(v.clients, key)
+	delete(v.cancels, key)
+}
+
+// update replaces the vault configs after a config reload. Clients of vaults that were removed or
+// changed are closed, and created again when next used.
+func (v *vaultClients) update(configs map[string]*vaultConfig) {
+	v.mut.Lock()
+	defer v.mut.Unlock()
+
+	for key := range v.clients {
+		current := v.configs[key.vault]
+		if next, ok := configs[key.vault]; ok && *next == *current {
+			continue
+		}
+
+		v.cancels[key]()
+		delete(v.clients, key)
+		delete(v.cancels, key)
+		v.l.Info("Vault client closed",
+			slog.String(loggingKeyVault, vaultDisplayName(key.vault)),
+			slog.String(loggingKeyRole, key.role),
+			slog.String(loggingKeyVaultNamespace, key.namespace),
+		)
+	}
+
+	clear(v.errs)
+	clear(v.attempts)
+	v.configs = configs
+}
+
+// newVaultClient logs in to the vault with the configured auth.
+func newVaultClient(ctx context.Context, l *slog.Logger, cfg *vaultConfig) (vaulty.Client, error) {
+	hashiCfg, err := cfg.hashiConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := cfg.authOption()
+	if err != nil {
+		return nil, err
+	}
+
+	return vaulty.NewClient(
+		vaulty.WithContext(ctx),
+		vaulty.WithConfig(hashiCfg),
+		auth,
+		vaulty.WithLogger(l),
+	)
+}
+
+// newRoleClient logs in to the vault with kubernetes auth as the given role, with the service
+// account token read from tokenPath. It returns the login's auth info, as the token is not renewed
+// by vaulty, see renewRoleToken.
+func newRoleClient(
+	ctx context.Context,
+	l *slog.Logger,
+	cfg *vaultConfig,
+	role, tokenPath string,
+) (vaulty.Client, *hashiVault.Secret, error) {
+	hashiCfg, err := cfg.hashiConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	token, err := readCredential(tokenPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading service account token: %w", err)
+	}
+
+	auth, err := kubernetesAuth.NewKubernetesAuth(role, kubernetesAuth.WithServiceAccountToken(token))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating kubernetes auth: %w", err)
+	}
+
+	loginClient, err := hashiVault.NewClient(hashiCfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating vault client: %w", err)
+	}
+
+	authInfo, err := loginClient.Auth().Login(ctx, auth)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error logging in as role %q: %w", role, err)
+	} else if authInfo == nil || authInfo.Auth == nil {
+		return nil, nil, fmt.Errorf("error logging in as role %q: no auth info returned", role)
+	}
+
+	client, err := vaulty.NewClient(
+		vaulty.WithContext(ctx),
+		vaulty.WithConfig(hashiCfg),
+		vaulty.WithTokenAuth(authInfo.Auth.ClientToken),
+		vaulty.WithLogger(l),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, authInfo, nil
+}
+
+// names returns the name of every vault, with the default vault as the empty name.
+func (v *vaultClients) names() []string {
+	v.mut.Lock()
+	defer v.mut.Unlock()
+	return sortedKeys(v.configs)
+}
+
+// healthCheck reports whether the named vault can be reached and is unsealed. A vault that has not
+// been used yet is healthy, unless creating one of its clients failed.
+func (v *vaultClients) healthCheck(name string) health.CheckFunc {
+	return func(ctx context.Context) error {
+		var client vaulty.Client
+		errs := make([]error, 0)
+
+		v.mut.Lock()
+		for key, c := range v.clients {
+			if key.vault == name {
+				client = c
+			}
+		}
+		for key, err := range v.errs {
+			if key.vault == name && key.role == "" {
+				errs = append(errs, err)
+			}
+		}
+		v.mut.Unlock()
+
+		if len(errs) > 0 || client == nil {
+			return errors.Join(errs...)
+		}
+
+		resp, err := client.Client().Sys().HealthWithContext(ctx)
+		if err != nil {
+			return fmt.Errorf("error checking vault health: %w", err)
+		} else if resp.Sealed {
+			return errors.New("vault is sealed")
+		}
+		return nil
+	}
+}
+
+// vaultHealthCheck returns a health check of every vault. The vaults are listed on every check, so
+// that vaults added or removed by a config reload are checked without registering the check again.
+func (a *App) vaultHealthCheck(l *slog.Logger) *health.Check {
+	return health.NewCheck(
+		"vaults",
+		func(ctx context.Context) error {
+			errs := make([]error, 0)
+			for _, name := range a.vaults.names() {
+				if err := a.vaults.healthCheck(name)(ctx); err != nil {
+					errs = append(errs, fmt.Errorf("vault %s: %w", vaultDisplayName(name), err))
+				}
+			}
+			return errors.Join(errs...)
+		},
+		health.WithCheckOnStatusChange(health.StandardStatusListener(l)),
+	)
+}
+
+// loadVaults sets up the client for every configured vault, and logs in to the default vault.
+func (a *App) loadVaults(ctx context.Context) error {
+	configs, err := parseVaults(a.base.Viper())
+	if err != nil {
+		return err
+	}
+
+	a.vaults = newVaultClients(
+		ctx,
+		logging.LoggerWithComponent(a.base.Logger(), "vault"),
+		configs,
+	)
+
+	if _, err := a.vaults.client(""); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseVaults reads and validates the vaults from the config.
+func parseVaults(vip *viper.Viper) (map[string]*vaultConfig, error) {
+	configs, err := decodeVaults(vip)
+	if err != nil {
+		return nil, err
+	}
+
+	if errs := validateVaults(configs); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid vaults: %w", errors.Join(errs...))
+	}
+	return configs, nil
+}
+
+// decodeVaults strictly decodes the vaults from the config, rejecting unknown fields. The default
+// vault, configured under vault, is keyed by the empty name.
+func decodeVaults(vip *viper.Viper) (map[string]*vaultConfig, error) {
+	configs := make(map[string]*vaultConfig)
+	if errs := decodeStrict(vip.Get("vaults"), &configs); len(errs) > 0 {
+		return nil, fmt.Errorf("error decoding vaults: %w", errors.Join(errs...))
+	}
+
+	vip.SetDefault("vault.address", defaultVaultAddress)
+	configs[""] = &vaultConfig{
+		Address:       vip.GetString("vault.address"),
+		Namespace:     vip.GetString("vault.namespace"),
+		NamespaceRole: vip.GetString("vault.namespace_role"),
+	}
+	return configs, nil
+}
+
+// validateVaults returns every problem with the vaults.
+func validateVaults(configs map[string]*vaultConfig) []error {
+	errs := make([]error, 0)
+	for _, name := range sortedKeys(configs) {
+		prefix := "vaults." + name
+		switch name {
+		case "":
+			prefix = "vault"
+		case defaultVaultName:
+			errs = append(errs, fmt.Errorf("%s: name is reserved for the vault configured under vault", prefix))
+			continue
+		}
+
+		if err := configs[name].Valid(); err != nil {
+			for _, e := range unjoin(err) {
+				errs = append(errs, fmt.Errorf("%s: %w", prefix, e))
+			}
+		}
+	}
+	return errs
+}
+
+// validateVaultRefs returns an error for every secret that reads from a vault that is not
+// configured.
+func validateVaultRefs(secrets []*Secret, configs map[string]*vaultConfig) []error {
+	errs := make([]error, 0)
+	for i, secret := range secrets {
+		if secret == nil || secret.Vault == "" {
+			continue
+		} else if _, ok := configs[secret.Vault]; !ok {
+			errs = append(errs, fmt.Errorf("secrets[%d]: %w: %q", i, ErrUnknownVault, secret.Vault))
+		}
+	}
+	return errs
+}
+
+// vaultDisplayName returns the name the vault is logged and reported as.
+func vaultDisplayName(name string) string {
+	if name == "" {
+		return defaultVaultName
+	}
+	return name
+}
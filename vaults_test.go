@@ -0,0 +1,535 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	hashiVault "github.com/hashicorp/vault/api"
+)
+
+// fakeVault serves the parts of the vault API that secrets are read and pushed with: health checks,
+// token lookups, AppRole and kubernetes logins, KV v2 reads, writes and metadata, and the event
+// stream if events is set.
+type fakeVault struct {
+	mut *sync.Mutex
+	srv *httptest.Server
+
+	// secrets, their current versions and custom metadata are keyed by mount and name. Secrets that
+	// were put but never written are at version 1.
+	secrets  map[string]map[string]any
+	versions map[string]int
+	metadata map[string]map[string]any
+
+	// racedWrites is the number of KV writes lost to another writer, which bumps the version just
+	// before the write is checked.
+	racedWrites int
+
+	// requests records every request served.
+	requests []vaultRequest
+
+	// events serves the KV v2 event stream.
+	events http.Handler
+
+	// jwts records the service account token of every kubernetes login, deniedRoles are the roles
+	// that cannot log in and the logins of hungRoles do not return until the request is cancelled.
+	jwts        []string
+	deniedRoles map[string]bool
+	hungRoles   map[string]bool
+
+	// loginTTL is the lease duration in seconds of kubernetes logins, which are not renewable.
+	loginTTL int
+}
+
+// vaultRequest is a request served by the fake vault, with the vault namespace it was sent to.
+type vaultRequest struct {
+	path      string
+	namespace string
+}
+
+func newFakeVault(tb testing.TB) *fakeVault {
+	tb.Helper()
+
+	v := &fakeVault{
+		mut:         new(sync.Mutex),
+		secrets:     make(map[string]map[string]any),
+		versions:    make(map[string]int),
+		metadata:    make(map[string]map[string]any),
+		deniedRoles: make(map[string]bool),
+		hungRoles:   make(map[string]bool),
+		loginTTL:    3600,
+	}
+	v.srv = httptest.NewServer(http.HandlerFunc(v.serveHTTP))
+	tb.Cleanup(v.srv.Close)
+	return v
+}
+
+// put stores the secret at the mount and name.
+func (v *fakeVault) put(mount, name string, data map[string]any) {
+	v.mut.Lock()
+	defer v.mut.Unlock()
+	v.secrets[mount+"/"+name] = data
+}
+
+// claim sets the custom metadata of the secret at the mount and name.
+func (v *fakeVault) claim(mount, name string, metadata map[string]any) {
+	v.mut.Lock()
+	defer v.mut.Unlock()
+	v.metadata[mount+"/"+name] = metadata
+}
+
+// version returns the current version of the secret at the mount and name, and its data.
+func (v *fakeVault) version(mount, name string) (int, map[string]any) {
+	v.mut.Lock()
+	defer v.mut.Unlock()
+
+	key := mount + "/" + name
+	version := v.versions[key]
+	if _, ok := v.secrets[key]; ok && version == 0 {
+		version = 1
+	}
+	return version, v.secrets[key]
+}
+
+// loginJWTs returns the service account token of every kubernetes login.
+func (v *fakeVault) loginJWTs() []string {
+	v.mut.Lock()
+	defer v.mut.Unlock()
+	return append([]string(nil), v.jwts...)
+}
+
+// namespaces returns the vault namespace of every request to the path.
+func (v *fakeVault) namespaces(path string) []string {
+	v.mut.Lock()
+	defer v.mut.Unlock()
+
+	namespaces := make([]string, 0)
+	for _, req := range v.requests {
+		if req.path == path {
+			namespaces = append(namespaces, req.namespace)
+		}
+	}
+	return namespaces
+}
+
+// config returns the config of a vault logging in to the fake vault with token auth.
+func (v *fakeVault) config(tb testing.TB) *vaultConfig {
+	tb.Helper()
+
+	tokenFile := filepath.Join(tb.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("test-token"), 0o600); err != nil {
+		tb.Fatalf("writing token file: %v", err)
+	}
+	return &vaultConfig{
+		Address:    v.srv.URL,
+		AuthMethod: vaultAuthToken,
+		TokenFile:  tokenFile,
+	}
+}
+
+func (v *fakeVault) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+
+	v.mut.Lock()
+	v.requests = append(v.requests, vaultRequest{
+		path:      path,
+		namespace: r.Header.Get(hashiVault.NamespaceHeaderName),
+	})
+	v.mut.Unlock()
+
+	switch {
+	case r.URL.Path == vaultEventsPath && v.events != nil:
+		v.events.ServeHTTP(w, r)
+	case path == "sys/health":
+		writeVaultResponse(w, map[string]any{"initialized": true, "sealed": false})
+	case path == "auth/token/lookup-self":
+		writeVaultResponse(w, map[string]any{"data": map[string]any{"ttl": 0}})
+	case path == "auth/approle/login":
+		writeVaultResponse(w, map[string]any{"auth": map[string]any{
+			"client_token":   "test-token",
+			"lease_duration": 3600,
+			"renewable":      true,
+		}})
+	case path == "auth/kubernetes/login":
+		login := new(struct {
+			JWT  string `json:"jwt"`
+			Role string `json:"role"`
+		})
+		if err := json.NewDecoder(r.Body).Decode(login); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			writeVaultResponse(w, map[string]any{"errors": []string{err.Error()}})
+			return
+		}
+
+		v.mut.Lock()
+		v.jwts = append(v.jwts, login.JWT)
+		denied, hung, ttl := v.deniedRoles[login.Role], v.hungRoles[login.Role], v.loginTTL
+		v.mut.Unlock()
+		if hung {
+			<-r.Context().Done()
+			return
+		} else if denied {
+			w.WriteHeader(http.StatusForbidden)
+			writeVaultResponse(w, map[string]any{"errors": []string{"permission denied"}})
+			return
+		}
+
+		writeVaultResponse(w, map[string]any{"auth": map[string]any{
+			"client_token":   "role-token",
+			"lease_duration": ttl,
+			"renewable":      false,
+		}})
+	case strings.Contains(path, "/metadata/"):
+		mount, name, _ := strings.Cut(path, "/metadata/")
+		v.serveMetadata(w, r, mount+"/"+name)
+	case strings.Contains(path, "/data/") && r.Method != http.MethodGet:
+		mount, name, _ := strings.Cut(path, "/data/")
+		v.serveWrite(w, r, mount+"/"+name)
+	case strings.Contains(path, "/data/"):
+		mount, name, _ := strings.Cut(path, "/data/")
+
+		version, data := v.version(mount, name)
+		if data == nil {
+			w.WriteHeader(http.StatusNotFound)
+			writeVaultResponse(w, map[string]any{"errors": []string{}})
+			return
+		}
+
+		writeVaultResponse(w, map[string]any{"data": map[string]any{
+			"data": data,
+			"metadata": map[string]any{
+				"version":      version,
+				"created_time": "2024-01-01T00:00:00Z",
+			},
+		}})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		writeVaultResponse(w, map[string]any{"errors": []string{"unsupported path " + path}})
+	}
+}
+
+// serveMetadata reads, replaces or merges the custom metadata of the secret at key.
+func (v *fakeVault) serveMetadata(w http.ResponseWriter, r *http.Request, key string) {
+	v.mut.Lock()
+	defer v.mut.Unlock()
+
+	_, exists := v.secrets[key]
+	metadata, claimed := v.metadata[key]
+	if r.Method == http.MethodGet {
+		if !exists && !claimed {
+			w.WriteHeader(http.StatusNotFound)
+			writeVaultResponse(w, map[string]any{"errors": []string{}})
+			return
+		}
+
+		version := v.versions[key]
+		if exists && version == 0 {
+			version = 1
+		}
+		writeVaultResponse(w, map[string]any{"data": map[string]any{
+			"current_version": version,
+			"custom_metadata": maps.Clone(metadata),
+		}})
+		return
+	}
+
+	body := new(struct {
+		CustomMetadata map[string]any `json:"custom_metadata"`
+	})
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeVaultResponse(w, map[string]any{"errors": []string{err.Error()}})
+		return
+	}
+
+	if r.Method == http.MethodPatch && metadata != nil {
+		maps.Copy(metadata, body.CustomMetadata)
+	} else {
+		v.metadata[key] = body.CustomMetadata
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveWrite writes a new version of the secret at key, if its check-and-set version matches.
+func (v *fakeVault) serveWrite(w http.ResponseWriter, r *http.Request, key string) {
+	body := new(struct {
+		Data    map[string]any `json:"data"`
+		Options struct {
+			CAS *int `json:"cas"`
+		} `json:"options"`
+	})
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeVaultResponse(w, map[string]any{"errors": []string{err.Error()}})
+		return
+	}
+
+	v.mut.Lock()
+	defer v.mut.Unlock()
+
+	if _, ok := v.secrets[key]; ok && v.versions[key] == 0 {
+		v.versions[key] = 1
+	}
+	if v.racedWrites > 0 {
+		v.racedWrites--
+		v.versions[key]++
+	}
+	if cas := body.Options.CAS; cas != nil && *cas != v.versions[key] {
+		w.WriteHeader(http.StatusBadRequest)
+		writeVaultResponse(w, map[string]any{"errors": []string{
+			"check-and-set parameter did not match the current version",
+		}})
+		return
+	}
+
+	v.versions[key]++
+	v.secrets[key] = body.Data
+	writeVaultResponse(w, map[string]any{"data": map[string]any{
+		"version":      v.versions[key],
+		"created_time": "2024-01-01T00:00:00Z",
+	}})
+}
+
+func writeVaultResponse(w http.ResponseWriter, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func TestVaultNamespaceHeader(t *testing.T) {
+	tests := []struct {
+		name           string
+		namespace      string
+		vaultNamespace string
+		want           string
+	}{
+		{
+			name:      "vault namespace",
+			namespace: "team-a",
+			want:      "team-a",
+		},
+		{
+			name:           "secret namespace",
+			namespace:      "team-a",
+			vaultNamespace: "team-b",
+			want:           "team-b",
+		},
+		{
+			name:           "secret namespace without vault namespace",
+			vaultNamespace: "team-b",
+			want:           "team-b",
+		},
+		{
+			name: "no namespace",
+			want: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := t.Context()
+			l := slog.New(slog.DiscardHandler)
+
+			vault := newFakeVault(t)
+			vault.put("secret", "app", map[string]any{"password": "hunter2"})
+
+			// Token auth logs in with a token lookup. AppRole auth is not used, as vaulty renews its
+			// token in a goroutine that races with creating the client.
+			cfg := vault.config(t)
+			cfg.Namespace = tt.namespace
+			s := &syncer{
+				vaults: newVaultClients(ctx, l, map[string]*vaultConfig{"": cfg}),
+			}
+
+			secret := &Secret{
+				Mount:                "secret",
+				Name:                 "app",
+				DestinationNamespace: "default",
+				DestinationName:      "app",
+				VaultNamespace:       tt.vaultNamespace,
+			}
+			if _, err := s.readFromVault(ctx, secret); err != nil {
+				t.Fatalf("reading secret: %v", err)
+			}
+
+			for _, path := range []string{"auth/token/lookup-self", "secret/data/app"} {
+				got := vault.namespaces(path)
+				if len(got) != 1 || got[0] != tt.want {
+					t.Errorf("namespaces of %s = %q, want [%q]", path, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestVaultRoleClients(t *testing.T) {
+	ctx := t.Context()
+	l := slog.New(slog.DiscardHandler)
+
+	vault := newFakeVault(t)
+	vault.put("secret", "app", map[string]any{"password": "hunter2"})
+	vault.deniedRoles["secret-sync-denied"] = true
+	vault.loginTTL = 1
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	writeToken := func(token string) {
+		t.Helper()
+		if err := os.WriteFile(tokenFile, []byte(token), 0o600); err != nil {
+			t.Fatalf("writing service account token: %v", err)
+		}
+	}
+	writeToken("jwt-1")
+
+	cfg := vault.config(t)
+	cfg.NamespaceRole = "secret-sync-{namespace}"
+	vaults := newVaultClients(ctx, l, map[string]*vaultConfig{"": cfg})
+	vaults.tokenPath = tokenFile
+	s := &syncer{vaults: vaults}
+
+	secret := func(namespace string) *Secret {
+		return &Secret{
+			Mount:                "secret",
+			Name:                 "app",
+			DestinationNamespace: namespace,
+			DestinationName:      "app",
+		}
+	}
+
+	if _, err := s.readFromVault(ctx, secret("team-a")); err != nil {
+		t.Fatalf("reading secret: %v", err)
+	}
+
+	// A role that cannot log in only fails its own secrets.
+	if _, err := s.readFromVault(ctx, secret("denied")); err == nil {
+		t.Error("reading secret with a denied role succeeded")
+	}
+	if err := vaults.healthCheck("")(ctx); err != nil {
+		t.Errorf("vault health check failed for a denied role: %v", err)
+	}
+
+	// The projected token is rotated, the next login once the lease ends reads the new token.
+	writeToken("jwt-2")
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := s.readFromVault(ctx, secret("team-a")); err != nil {
+			t.Fatalf("reading secret: %v", err)
+		} else if slices.Contains(vault.loginJWTs(), "jwt-2") {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("client did not log in again once its lease ended")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if jwts := vault.loginJWTs(); jwts[0] != "jwt-1" {
+		t.Errorf("first login used %q, want jwt-1", jwts[0])
+	}
+}
+
+func TestVaultRoleLoginDoesNotBlock(t *testing.T) {
+	ctx := t.Context()
+	l := slog.New(slog.DiscardHandler)
+
+	vault := newFakeVault(t)
+	vault.put("secret", "app", map[string]any{"password": "hunter2"})
+	vault.hungRoles["secret-sync-hung"] = true
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("jwt"), 0o600); err != nil {
+		t.Fatalf("writing service account token: %v", err)
+	}
+
+	cfg := vault.config(t)
+	cfg.NamespaceRole = "secret-sync-{namespace}"
+	vaults := newVaultClients(ctx, l, map[string]*vaultConfig{"": cfg})
+	vaults.tokenPath = tokenFile
+	s := &syncer{vaults: vaults}
+
+	secret := func(namespace string) *Secret {
+		return &Secret{
+			Mount:                "secret",
+			Name:                 "app",
+			DestinationNamespace: namespace,
+			DestinationName:      "app",
+		}
+	}
+
+	go func() {
+		_, _ = s.readFromVault(ctx, secret("hung"))
+	}()
+
+	// Wait for the hung login to reach the vault.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(vault.loginJWTs()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("hung role did not log in")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		if _, err := s.readFromVault(ctx, secret("team-a")); err != nil {
+			done <- err
+			return
+		}
+		done <- vaults.healthCheck("")(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("reading secret while another role logs in: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read with one role was blocked by the login of another")
+	}
+}
+
+func TestVaultLoginBackoff(t *testing.T) {
+	ctx := t.Context()
+	l := slog.New(slog.DiscardHandler)
+
+	vault := newFakeVault(t)
+	vault.deniedRoles["secret-sync-denied"] = true
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("jwt"), 0o600); err != nil {
+		t.Fatalf("writing service account token: %v", err)
+	}
+
+	cfg := vault.config(t)
+	cfg.NamespaceRole = "secret-sync-{namespace}"
+	vaults := newVaultClients(ctx, l, map[string]*vaultConfig{"": cfg})
+	vaults.tokenPath = tokenFile
+
+	secret := &Secret{DestinationNamespace: "denied"}
+	for range 3 {
+		if _, err := vaults.forSecret(secret); err == nil {
+			t.Fatal("creating client for a denied role succeeded")
+		}
+	}
+	if got := len(vault.loginJWTs()); got != 1 {
+		t.Errorf("denied role logged in %d times, want 1 until the retry interval passes", got)
+	}
+
+	// Once the retry interval has passed, the next read logs in again.
+	vaults.mut.Lock()
+	for key := range vaults.attempts {
+		vaults.attempts[key] = time.Now().Add(-vaultRetryInterval)
+	}
+	vaults.mut.Unlock()
+	if _, err := vaults.forSecret(secret); err == nil {
+		t.Fatal("creating client for a denied role succeeded")
+	}
+	if got := len(vault.loginJWTs()); got != 2 {
+		t.Errorf("denied role logged in %d times, want 2 after the retry interval", got)
+	}
+}
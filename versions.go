@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+
+	hashiVault "github.com/hashicorp/vault/api"
+	corev1 "k8s.io/api/core/v1"
+	coreErr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// defaultRetainVersions is the number of versioned Secrets kept when retain_versions is not set.
+	defaultRetainVersions = 3
+
+	// secretLabelDestination and secretLabelVersion are set on versioned Secrets, with the
+	// destination name they are versions of and the vault version they hold.
+	secretLabelDestination = "secret-sync/destination"
+	secretLabelVersion     = "secret-sync/version"
+
+	// pointerKeyName and pointerKeyVersion are the keys of the pointer Secret, holding the name and
+	// vault version of the current versioned Secret.
+	pointerKeyName    = "name"
+	pointerKeyVersion = "version"
+
+	// maxVersionSuffix is the length of the longest suffix added to versioned Secret names.
+	maxVersionSuffix = len("-v") + 10
+)
+
+var (
+	ErrImmutableOption       = errors.New("not supported with immutable")
+	ErrInvalidRetainVersions = errors.New("retain_versions must be positive")
+	ErrUnknownVaultVersion   = errors.New("vault version of the secret is unknown")
+)
+
+// versionedSecret is a versioned Secret synced from a secret, with the vault version it holds.
+type versionedSecret struct {
+	secret  *corev1.Secret
+	version int
+}
+
+// retainVersions returns the number of versioned Secrets kept.
+func (s *Secret) retainVersions() int {
+	if s.RetainVersions == 0 {
+		return defaultRetainVersions
+	}
+	return s.RetainVersions
+}
+
+// versionedName returns the name of the Secret holding the given vault version.
+func versionedName(name string, version int) string {
+	return name + "-v" + strconv.Itoa(version)
+}
+
+// versionOf returns the copy of the secret synced into the Secret holding the given vault version.
+func (s *Secret) versionOf(version int) *Secret {
+	v := *s
+	v.DestinationName = versionedName(s.DestinationName, version)
+	return &v
+}
+
+// pointer returns the copy of the secret synced into the pointer Secret at the destination name.
+func (s *Secret) pointer() *Secret {
+	p := *s
+	p.Type = ""
+	return &p
+}
+
+// buildVersion returns the immutable Secret holding the given vault version, and the content its
+// hash was computed from.
+func (s *Secret) buildVersion(value map[string]any, version int, hasher *contentHasher) (*corev1.Secret, []byte, error) {
+	newSecret, content, err := s.versionOf(version).build(value, hasher)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	immutable := true
+	newSecret.Immutable = &immutable
+	newSecret.Labels[secretLabelDestination] = s.DestinationName
+	newSecret.Labels[secretLabelVersion] = strconv.Itoa(version)
+	return newSecret, content, nil
+}
+
+// upsertVersioned creates the immutable Secret for the vault version, points the pointer Secret at
+// it and removes the versions beyond the secret's retention, or plans this when running dry. A
+// versioned Secret whose content no longer matches, such as after its type is changed, is replaced.
+func (s *syncer) upsertVersioned(
+	ctx context.Context,
+	l *slog.Logger,
+	secret *Secret,
+	vaultSecret *hashiVault.KVSecret,
+) (*syncResult, error) {
+	version := vaultVersion(vaultSecret)
+	if version == 0 {
+		return nil, ErrUnknownVaultVersion
+	}
+	l = l.With(slog.Int(loggingKeyVersion, version))
+
+	versioned := secret.versionOf(version)
+	newSecret, content, err := secret.buildVersion(vaultSecret.Data, version, s.hasher)
+	if err != nil {
+		return nil, err
+	}
+	hash := newSecret.Annotations[secretAnnotationSyncIdKey]
+
+	existing, err := s.secretLister.Secrets(secret.DestinationNamespace).Get(versioned.DestinationName)
+	action := changeActionUnchanged
+	switch {
+	case coreErr.IsNotFound(err):
+		action = changeActionCreate
+	case err != nil:
+		return nil, fmt.Errorf("error getting existing secret: %w", err)
+	case !versioned.syncedFrom(existing):
+		return nil, fmt.Errorf("secret %s/%s is not managed by %s", versioned.DestinationNamespace, versioned.DestinationName, appName)
+	case !s.hasher.matches(existing.Annotations[secretAnnotationSyncIdKey], content) && !sameContent(existing, newSecret):
+		// A version whose annotation was recorded under another hashing key is kept while its content
+		// is the same, immutable Secrets cannot be migrated without replacing them.
+		action = changeActionUpdate
+	default:
+		hash = existing.Annotations[secretAnnotationSyncIdKey]
+	}
+
+	pointerData := map[string]any{
+		pointerKeyName:    versioned.DestinationName,
+		pointerKeyVersion: strconv.Itoa(version),
+	}
+
+	if s.plan != nil {
+		change := &secretChange{
+			Action:    action,
+			Cluster:   secret.cluster,
+			Namespace: versioned.DestinationNamespace,
+			Name:      versioned.DestinationName,
+			hash:      hash,
+		}
+		if action == changeActionCreate {
+			change.Added = sortedKeys(newSecret.Data)
+		} else if action == changeActionUpdate {
+			change.Added, change.Removed, change.Changed = diffKeys(existing.Data, newSecret.Data)
+			change.Reason = "replaced as it is immutable"
+		}
+		s.plan.add(change)
+
+		pointerChange, err := secret.pointer().Diff(ctx, s.kubeClient, s.secretLister, s.hasher, pointerData)
+		if err != nil {
+			return nil, fmt.Errorf("error diffing pointer secret: %w", err)
+		}
+		s.plan.add(pointerChange)
+		if pointerChange.Action == changeActionConflict {
+			return nil, fmt.Errorf("secret %s/%s is not managed by %s", secret.DestinationNamespace, secret.DestinationName, appName)
+		}
+	} else {
+		if action == changeActionUpdate {
+			// Immutable Secrets cannot be updated, only replaced.
+			if err := s.kubeClient.CoreV1().Secrets(secret.DestinationNamespace).Delete(ctx, versioned.DestinationName, metav1.DeleteOptions{}); err != nil && !coreErr.IsNotFound(err) {
+				return nil, fmt.Errorf("error replacing versioned secret: %w", err)
+			}
+		}
+		if action != changeActionUnchanged {
+			if _, err := s.kubeClient.CoreV1().Secrets(secret.DestinationNamespace).Create(ctx, newSecret, metav1.CreateOptions{}); err != nil {
+				return nil, fmt.Errorf("error creating versioned secret: %w", err)
+			}
+			l.Info("Versioned secret created", slog.String(loggingKeyDestination, versioned.DestinationName))
+		}
+
+		upserted, err := secret.pointer().Upsert(ctx, s.kubeClient, s.secretLister, s.hasher, pointerData)
+		if err != nil {
+			return nil, fmt.Errorf("error upserting pointer secret: %w", err)
+		} else if upserted.changed {
+			s.reload.Notify(ctx, secret.DestinationNamespace, secret.DestinationName)
+		}
+	}
+
+	if err := s.pruneVersions(ctx, l, secret, version); err != nil {
+		return nil, err
+	}
+
+	return &syncResult{
+		vaultVersion: version,
+		hash:         hash,
+	}, nil
+}
+
+// versions returns the versioned Secrets synced from the secret, newest first.
+func (s *syncer) versions(secret *Secret) ([]*versionedSecret, error) {
+	found, err := s.secretLister.Secrets(secret.DestinationNamespace).List(labels.SelectorFromSet(labels.Set{
+		secretLabelManagedBy:   appName,
+		secretLabelDestination: secret.DestinationName,
+	}))
+	if err != nil {
+		return nil, fmt.Errorf("error listing versioned secrets: %w", err)
+	}
+
+	versions := make([]*versionedSecret, 0, len(found))
+	for _, v := range found {
+		version, err := strconv.Atoi(v.Labels[secretLabelVersion])
+		if err != nil || !secret.syncedFrom(v) {
+			continue
+		}
+		versions = append(versions, &versionedSecret{secret: v, version: version})
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].version > versions[j].version
+	})
+	return versions, nil
+}
+
+// pruneVersions deletes the versioned Secrets beyond the secret's retention, newest first. The
+// current version is always kept.
+func (s *syncer) pruneVersions(ctx context.Context, l *slog.Logger, secret *Secret, current int) error {
+	versions, err := s.versions(secret)
+	if err != nil {
+		return err
+	}
+
+	kept := 0
+	for _, v := range versions {
+		if v.version == current || kept < secret.retainVersions()-1 {
+			if v.version != current {
+				kept++
+			}
+			continue
+		}
+
+		s.deleteVersion(ctx, l, secret, v, "beyond retain_versions")
+	}
+	return nil
+}
+
+// deleteVersion deletes a versioned Secret, or plans the deletion when running dry.
+func (s *syncer) deleteVersion(ctx context.Context, l *slog.Logger, secret *Secret, v *versionedSecret, reason string) {
+	if s.plan != nil {
+		s.plan.add(&secretChange{
+			Action:    changeActionDelete,
+			Cluster:   secret.cluster,
+			Namespace: v.secret.Namespace,
+			Name:      v.secret.Name,
+			Reason:    reason,
+		})
+		return
+	}
+
+	if err := s.kubeClient.CoreV1().Secrets(v.secret.Namespace).Delete(ctx, v.secret.Name, metav1.DeleteOptions{}); err != nil && !coreErr.IsNotFound(err) {
+		l.Error("Error deleting versioned secret", slog.String(loggingKeyError, err.Error()))
+		return
+	}
+	auditDeletion(l, v.secret, reason, false)
+}
+
+// removeVersions deletes every versioned Secret synced from the secret.
+func (s *syncer) removeVersions(ctx context.Context, l *slog.Logger, secret *Secret, reason string) {
+	versions, err := s.versions(secret)
+	if err != nil {
+		l.Error("Error getting versioned secrets to remove", slog.String(loggingKeyError, err.Error()))
+		return
+	}
+
+	for _, v := range versions {
+		s.deleteVersion(ctx, l, secret, v, reason)
+	}
+}